@@ -0,0 +1,146 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/deliveroo/autoreloader-go/watcher"
+)
+
+// ctlCommands maps each ctl command to its HTTP method and path.
+var ctlCommands = map[string][2]string{
+	"status":  {"GET", "/status"},
+	"restart": {"POST", "/restart"},
+	"stop":    {"POST", "/stop"},
+	"start":   {"POST", "/start"},
+	"pause":   {"POST", "/pause"},
+	"resume":  {"POST", "/resume"},
+	"rebuild": {"POST", "/rebuild"},
+	"logs":    {"GET", "/logs"},
+}
+
+// ctl runs the ctl subcommand with the given arguments, talking to a
+// running instance over its control API.
+func ctl(args []string) {
+	fs := flag.NewFlagSet("ctl", flag.ExitOnError)
+	var (
+		control = fs.String("control", os.Getenv("AUTORELOADER_CONTROL"), "control address of the running instance (default $AUTORELOADER_CONTROL)")
+		asJSON  = fs.Bool("json", false, "print the status as JSON")
+		follow  = fs.Bool("f", false, "follow the logs")
+		lines   = fs.Int("n", 100, "number of lines of logs to print")
+	)
+	fs.Usage = func() {
+		fmt.Printf("usage: %s ctl [flags] status|restart|stop|start|pause|resume|rebuild|logs [flags]\n", os.Args[0])
+		fs.PrintDefaults()
+		os.Exit(1)
+	}
+
+	// Allow flags either side of the command, as in "ctl status --json".
+	must(fs.Parse(args), "")
+	if fs.NArg() == 0 {
+		fs.Usage()
+	}
+	name := fs.Arg(0)
+	must(fs.Parse(fs.Args()[1:]), "")
+	endpoint, ok := ctlCommands[name]
+	if !ok || fs.NArg() > 0 {
+		fs.Usage()
+	}
+	if *control == "" {
+		log.Fatal("no control address; pass -control or set AUTORELOADER_CONTROL")
+	}
+
+	path := endpoint[1]
+	if name == "logs" {
+		q := url.Values{"lines": {fmt.Sprint(*lines)}}
+		if *follow {
+			q.Set("follow", "true")
+		}
+		path += "?" + q.Encode()
+	}
+	req, err := http.NewRequest(endpoint[0], "http://autoreloader"+path, nil)
+	must(err, "")
+	resp, err := ctlClient(*control, *follow).Do(req)
+	must(err, "failed to reach autoreloader")
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		// Errors are JSON, other than those of logs, which are text.
+		body, _ := ioutil.ReadAll(resp.Body)
+		var e struct{ Error string }
+		if json.Unmarshal(body, &e) == nil && e.Error != "" {
+			log.Fatalf("%s: %s", name, e.Error)
+		}
+		if msg := strings.TrimSpace(string(body)); msg != "" {
+			log.Fatalf("%s: %s", name, msg)
+		}
+		log.Fatalf("%s: %s", name, resp.Status)
+	}
+	if name == "logs" {
+		_, _ = io.Copy(os.Stdout, resp.Body)
+		return
+	}
+
+	body, err := ioutil.ReadAll(resp.Body)
+	must(err, "")
+	if *asJSON {
+		os.Stdout.Write(body)
+		return
+	}
+	var st watcher.Status
+	must(json.Unmarshal(body, &st), "invalid status")
+	printStatus(st)
+}
+
+// ctlClient returns an HTTP client connecting to the given control
+// address. Unless following, requests time out.
+func ctlClient(control string, follow bool) *http.Client {
+	network, address := watcher.ControlAddr(control)
+	var d net.Dialer
+	c := &http.Client{
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				return d.DialContext(ctx, network, address)
+			},
+		},
+	}
+	if !follow {
+		c.Timeout = 30 * time.Second
+	}
+	return c
+}
+
+// printStatus prints the status for humans.
+func printStatus(st watcher.Status) {
+	var parts []string
+	if st.PID != 0 {
+		parts = append(parts, fmt.Sprintf("pid %d", st.PID))
+		uptime := time.Duration(st.Uptime * float64(time.Second)).Round(time.Second)
+		parts = append(parts, fmt.Sprintf("up %s", uptime))
+		if st.Ready {
+			parts = append(parts, "ready")
+		} else {
+			parts = append(parts, "not ready")
+		}
+	}
+	parts = append(parts, fmt.Sprintf("%d restarts", st.Restarts))
+	if st.LastExitCode != 0 {
+		parts = append(parts, fmt.Sprintf("last exit code %d", st.LastExitCode))
+	}
+	if st.Paused {
+		parts = append(parts, "watching paused")
+	}
+	parts = append(parts, fmt.Sprintf("%d files watched", st.WatchedFiles))
+	fmt.Printf("%s: %s\n", st.State, strings.Join(parts, ", "))
+}
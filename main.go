@@ -5,54 +5,378 @@ import (
 	"fmt"
 	"io"
 	"log"
+	"net"
+	"net/http"
+	"net/url"
 	"os"
 	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
 
 	"github.com/deliveroo/autoreloader-go/watcher"
 )
 
 func main() {
+	watcher.ExecListenShim()
+
+	// "ctl" is only a subcommand as the first argument, so a binary
+	// called ctl can still be run as, say, "autoreloader-go -- ctl".
+	if len(os.Args) > 1 && os.Args[1] == "ctl" {
+		log.SetFlags(0)
+		ctl(os.Args[2:])
+		return
+	}
+
+	var listen, watch, goPkgs, rules stringsFlag
+	flag.Var(&listen, "listen", "address to listen on and pass to the binary via LISTEN_FDS; may be repeated")
+	flag.Var(&watch, "watch", "path to watch instead of the binary; may be repeated")
+	flag.Var(&goPkgs, "go-pkg", "Go package of the binary, such as ./cmd/api, whose source files to watch instead of the binary, requiring -build or -pipeline; may be repeated")
+	flag.Var(&rules, "rule", "pattern=action for changes to matching paths, where the action is none, restart, rebuild, signal:HUP or exec:command; may be repeated")
 	var (
 		autorestart   = flag.Bool("autorestart", false, "automatically restarts the binary upon non-zero exit code")
 		enablePolling = flag.Bool("poll", false, "use polling, not fsnotify, to monitor binary")
+		monorepo      = flag.String("monorepo", "", "space-separated patterns of main packages, such as ./cmd/..., to build and supervise instead of a binary, rebuilding only those affected by a change")
+		binDir        = flag.String("bin-dir", "bin", "directory which -monorepo builds the binaries into")
+		jobs          = flag.Int("jobs", 0, "number of binaries which -monorepo builds at once (default the number of CPUs)")
+		useFanotify   = flag.Bool("fanotify", false, "use fanotify, not fsnotify, to monitor everything under the watched paths; Linux only, requiring CAP_SYS_ADMIN")
+		on            = flag.String("on", "create,write,remove,rename", "comma-separated operations which count as a change: create, write, remove, rename or chmod")
 		interval      = flag.Int("interval", 0, "interval for polling and pausing")
+		pollMax       = flag.Int("poll-max", 2000, "interval in milliseconds which -poll backs off to while nothing changes")
+		pollWorkers   = flag.Int("poll-workers", 8, "number of files which -poll stats at once")
+		pollHash      = flag.Bool("poll-hash", false, "make -poll compare the contents of files too, reading them on every poll")
+		readiness     = flag.String("readiness", "", "probe reporting when the binary is ready: http://..., tcp://host:port or exec:command")
+		liveness      = flag.String("liveness", "", "probe restarting the binary once it fails, in the same format as -readiness")
+		probeInterval = flag.Int("probe-interval", 1000, "interval in milliseconds between probe checks")
+		probeTimeout  = flag.Int("probe-timeout", 1000, "timeout in milliseconds for a single probe check")
+		probeDelay    = flag.Int("probe-delay", 0, "delay in milliseconds before the first probe check")
+		probeSuccess  = flag.Int("probe-success-threshold", 1, "consecutive successes before a probe passes")
+		probeFailure  = flag.Int("probe-failure-threshold", 3, "consecutive failures before a probe fails")
+		dir           = flag.String("dir", "", "working directory of the binary")
+		runAs         = flag.String("user", "", "user, or uid, to run the binary as")
+		group         = flag.String("group", "", "group, or gid, to run the binary as, instead of the -user's primary group")
+		groups        = flag.String("groups", "", "comma-separated supplementary groups of the binary, instead of the -user's")
+		build         = flag.String("build", "", "command to build the binary before every start")
+		pipeline      = flag.String("pipeline", "", "JSON file of build steps to run instead of -build, skipping those whose inputs are unchanged")
+		quickfix      = flag.String("quickfix", "", "file to write the errors of a failed -build to, for vim's :cfile")
+		testFirst     = flag.Bool("test-before-restart", false, "run go test for the packages of the changed Go files, and restart only if they pass")
+		testRun       = flag.String("test-run", "", "regular expression passed to go test's -run by -test-before-restart")
+		testShort     = flag.Bool("test-short", false, "pass -short to go test for -test-before-restart")
+		preStart      = flag.String("pre-start", "", "command to run before every start of the binary, such as migrations")
+		postStart     = flag.String("post-start", "", "command to run once every start of the binary is ready")
+		preStop       = flag.String("pre-stop", "", "command to run before the binary is stopped")
+		postStop      = flag.String("post-stop", "", "command to run once the binary has exited")
+		hookTimeout   = flag.Int("hook-timeout", 30, "timeout in seconds for each hook command, or 0 for none")
+		hookFailure   = flag.String("hook-failure", "abort", "what a failed -pre-start or -post-start does: ignore, abort until the next change, or exit")
+		proxyAddr     = flag.String("proxy", "", "address for a reverse proxy which holds requests while the binary restarts")
+		proxyTo       = flag.String("proxy-to", "", "upstream address of the binary for -proxy")
+		liveReload    = flag.String("livereload", "", "address for a server telling browsers to reload once the binary restarts")
+		inject        = flag.Bool("livereload-inject", false, "serve live reload on the -proxy and inject its script into HTML pages")
+		control       = flag.String("control", "", "Unix socket path, or host:port on localhost, to serve the control API on")
+		interactive   = flag.Bool("interactive", false, "read single keys from the terminal to restart, rebuild, pause, clear or quit")
+		metricsAddr   = flag.String("metrics-addr", "", "address to serve Prometheus metrics on, at /metrics")
+		prefix        = flag.String("prefix", "", "prefix for every line of the binary's output")
+		timestamps    = flag.String("timestamps", "", "timestamp every line of the binary's output: rfc3339 or relative")
+		color         = flag.Bool("color", false, "colour the -prefix and highlight the binary's stderr")
+		logFile       = flag.String("log-file", "", "file to copy the binary's output to")
+		logFileSize   = flag.Int("log-file-max-size", 0, "size in megabytes after which the -log-file is rotated")
+		logFileDaily  = flag.Bool("log-file-daily", false, "rotate the -log-file at midnight")
+		logBackups    = flag.Int("log-file-backups", 5, "number of gzipped -log-file backups, or previous -log-file-per-restart files, to keep")
+		logPerRestart = flag.Bool("log-file-per-restart", false, "start a new -log-file for each restart, numbered by generation")
+		logFormat     = flag.String("log-format", "text", "format of the supervisor's own messages on stderr: text or json")
+		logLevel      = flag.String("log-level", "info", "minimum level of the supervisor's own messages: debug, info, warn or error")
 		help          = flag.Bool("?", false, "prints the usage")
 	)
 	log.SetFlags(0)
 	flag.Usage = usage
 	flag.Parse()
-	if *help || len(flag.Args()) == 0 {
+	if *help || len(flag.Args()) == 0 && *monorepo == "" {
 		usage()
 	}
 
+	// In monorepo mode, the arguments are passed to every binary.
+	var cmd string
+	argv := flag.Args()
+	if *monorepo == "" {
+		cmd, argv = argv[0], argv[1:]
+	} else {
+		for name, set := range map[string]bool{
+			"-build":        *build != "",
+			"-pipeline":     *pipeline != "",
+			"-go-pkg":       len(goPkgs) > 0,
+			"-listen":       len(listen) > 0,
+			"-readiness":    *readiness != "",
+			"-liveness":     *liveness != "",
+			"-proxy":        *proxyAddr != "",
+			"-livereload":   *liveReload != "",
+			"-control":      *control != "",
+			"-interactive":  *interactive,
+			"-metrics-addr": *metricsAddr != "",
+		} {
+			if set {
+				log.Fatalf("%s is not supported with -monorepo", name)
+			}
+		}
+	}
+
+	// Changes to the source only reach the binary if it is rebuilt.
+	if len(goPkgs) > 0 && *build == "" && *pipeline == "" {
+		log.Fatal("-go-pkg requires -build or -pipeline")
+	}
+
+	// Watch the binary itself unless told otherwise. A relative path
+	// is relative to the binary's working directory.
+	if len(watch) == 0 && len(goPkgs) == 0 && *monorepo == "" {
+		path := cmd
+		if *dir != "" && strings.ContainsRune(cmd, filepath.Separator) && !filepath.IsAbs(cmd) {
+			path = filepath.Join(*dir, cmd)
+		}
+		cmdFullPath, err := exec.LookPath(path)
+		must(err, "")
+		watch = append(watch, cmdFullPath)
+	}
+
 	var (
-		cmd  = flag.Arg(0)
-		argv = flag.Args()[1:]
+		w   watcher.Watcher
+		sup *watcher.Supervisor
 	)
+	switch {
+	case *enablePolling && *useFanotify:
+		log.Fatal("-poll and -fanotify are exclusive")
+	case *useFanotify:
+		f, err := watcher.NewFanotify(*autorestart, *interval, cmd, argv)
+		must(err, "")
+		w, sup = f, &f.Supervisor
+	case *enablePolling:
+		p := watcher.NewPoller(*autorestart, *interval, cmd, argv)
+		p.MaxInterval = time.Duration(*pollMax) * time.Millisecond
+		p.Workers = *pollWorkers
+		p.Hash = *pollHash
+		w, sup = p, &p.Supervisor
+	default:
+		n, err := watcher.NewNotifier(*autorestart, *interval, cmd, argv)
+		must(err, "")
+		w, sup = n, &n.Supervisor
+	}
+	defer mustClose(w)
 
-	// Find the full path for the command.
-	cmdFullPath, err := exec.LookPath(cmd)
+	logger, err := watcher.NewLogger(os.Stderr, *logFormat)
 	must(err, "")
+	logger.Level, err = watcher.ParseLevel(*logLevel)
+	must(err, "")
+	sup.Log = logger
 
-	var w watcher.Watcher
-	if *enablePolling {
-		w = watcher.NewPoller(*autorestart, *interval, cmd, argv)
-	} else {
-		n, err := watcher.NewNotifier(*autorestart, *interval, cmd, argv)
+	sup.Ops, err = watcher.ParseOps(*on)
+	must(err, "invalid -on")
+
+	switch *timestamps {
+	case "", "rfc3339", "relative":
+	default:
+		log.Fatalf("unknown timestamps %q", *timestamps)
+	}
+	if *logFile != "" {
+		sup.LogFile = &watcher.LogFile{
+			Path:          *logFile,
+			MaxSize:       int64(*logFileSize) << 20,
+			Daily:         *logFileDaily,
+			MaxBackups:    *logBackups,
+			PerGeneration: *logPerRestart,
+			Log:           sup.Log,
+		}
+		defer mustClose(sup.LogFile)
+	}
+
+	if *prefix != "" || *timestamps != "" || *color {
+		sup.Output = &watcher.Output{
+			Prefix:     *prefix,
+			Timestamps: *timestamps,
+			Color:      *color,
+		}
+	}
+
+	// Configure the optional health probes.
+	probe := func(spec string) *watcher.Probe {
+		if spec == "" {
+			return nil
+		}
+		p, err := watcher.ParseProbe(spec)
+		must(err, "invalid probe")
+		if *probeInterval <= 0 || *probeTimeout <= 0 {
+			log.Fatal("-probe-interval and -probe-timeout must be positive")
+		}
+		p.Interval = time.Duration(*probeInterval) * time.Millisecond
+		p.Timeout = time.Duration(*probeTimeout) * time.Millisecond
+		p.InitialDelay = time.Duration(*probeDelay) * time.Millisecond
+		p.SuccessThreshold = *probeSuccess
+		p.FailureThreshold = *probeFailure
+		return p
+	}
+	if *proxyAddr != "" {
+		if *proxyTo == "" {
+			log.Fatal("-proxy requires -proxy-to")
+		}
+		// The proxy holds requests until the upstream accepts them,
+		// unless a better readiness probe was given.
+		if *readiness == "" {
+			u, err := url.Parse(watcher.UpstreamURL(*proxyTo))
+			must(err, "invalid upstream")
+			*readiness = "tcp://" + u.Host
+		}
+	}
+	sup.Readiness = probe(*readiness)
+	sup.Liveness = probe(*liveness)
+
+	for _, addr := range listen {
+		must(sup.Listen(addr), "")
+	}
+
+	if *dir != "" {
+		fi, err := os.Stat(*dir)
+		must(err, "invalid -dir")
+		if !fi.IsDir() {
+			log.Fatalf("invalid -dir: %s is not a directory", *dir)
+		}
+		sup.Dir = *dir
+	}
+	if *runAs != "" || *group != "" || *groups != "" {
+		var supplementary []string
+		if *groups != "" {
+			supplementary = strings.Split(*groups, ",")
+		}
+		must(sup.RunAs(*runAs, *group, supplementary), "")
+	}
+
+	sup.Build = strings.Fields(*build)
+	if *pipeline != "" {
+		if *build != "" {
+			log.Fatal("-build and -pipeline are exclusive")
+		}
+		sup.Pipeline, err = watcher.LoadPipeline(*pipeline)
 		must(err, "")
-		w = n
 	}
-	defer mustClose(w)
+	sup.Quickfix = *quickfix
+	if *testFirst {
+		sup.Tests = &watcher.Tests{Run: *testRun, Short: *testShort}
+	}
+
+	for _, spec := range rules {
+		r, err := watcher.ParseRule(spec)
+		must(err, "")
+		sup.Rules = append(sup.Rules, r)
+	}
+
+	if *preStart != "" || *postStart != "" || *preStop != "" || *postStop != "" {
+		switch *hookFailure {
+		case watcher.HookIgnore, watcher.HookAbort, watcher.HookExit:
+		default:
+			log.Fatalf("unknown hook failure policy %q", *hookFailure)
+		}
+		sup.Hooks = &watcher.Hooks{
+			PreStart:  strings.Fields(*preStart),
+			PostStart: strings.Fields(*postStart),
+			PreStop:   strings.Fields(*preStop),
+			PostStop:  strings.Fields(*postStop),
+			Timeout:   time.Duration(*hookTimeout) * time.Second,
+			OnFailure: *hookFailure,
+		}
+	}
+
+	if *control != "" {
+		sup.Tail = watcher.NewTail(1000)
+		l, err := watcher.ListenControl(*control)
+		must(err, "")
+		go func() {
+			must(http.Serve(l, watcher.NewControl(sup)), "control")
+		}()
+	}
+
+	if *metricsAddr != "" {
+		mux := http.NewServeMux()
+		mux.Handle("/metrics", watcher.NewMetrics(sup))
+		l, err := net.Listen("tcp", *metricsAddr)
+		must(err, "failed to serve metrics")
+		go func() {
+			must(http.Serve(l, mux), "metrics")
+		}()
+	}
+
+	if *liveReload != "" {
+		l, err := net.Listen("tcp", *liveReload)
+		must(err, "failed to start live reload")
+		go func() {
+			must(http.Serve(l, watcher.NewLiveReload(sup.Subscribe())), "live reload")
+		}()
+	}
+
+	if *proxyAddr != "" {
+		p, err := watcher.NewProxy(*proxyTo, sup.Subscribe())
+		must(err, "")
+		if *inject {
+			p.LiveReload = watcher.NewLiveReload(sup.Subscribe())
+		}
+		l, err := net.Listen("tcp", *proxyAddr)
+		must(err, "failed to start proxy")
+		go func() {
+			must(http.Serve(l, p), "proxy")
+		}()
+	}
 
 	mustNotNil(w, "watcher not initialized")
-	must(w.Add(cmdFullPath), "failed to watch")
-	go w.Watch()
-	go must(w.Start(), "failed to start")
+	for _, path := range watch {
+		must(w.Add(path), "failed to watch")
+	}
+	if len(goPkgs) > 0 {
+		g := watcher.NewGoPackages(w, sup.Log, goPkgs)
+		must(g.Update(), "failed to watch Go packages")
+		sup.GoPackages = g
+	}
+	if *monorepo != "" {
+		m, err := watcher.NewMonorepo(w, strings.Fields(*monorepo))
+		must(err, "failed to list binaries")
+		m.BinDir = *binDir
+		if *jobs > 0 {
+			m.Jobs = *jobs
+		}
+		w = m
+	} else {
+		sup.PauseOnSignals()
+	}
+	if *interactive {
+		restore, err := sup.Interactive(os.Stdin, func() { mustClose(w) })
+		if err != nil {
+			sup.Log.Warn("not interactive", watcher.Fields{"error": err.Error()})
+		} else {
+			defer restore()
+		}
+	}
+
+	// Wait for the command to be stopped once the watcher is closed.
+	watching := make(chan struct{})
+	go func() {
+		w.Watch()
+		close(watching)
+	}()
+	must(w.Start(), "failed to start")
+	<-watching
+}
+
+// stringsFlag is a flag which may be given more than once.
+type stringsFlag []string
+
+func (f *stringsFlag) String() string {
+	return strings.Join(*f, ",")
+}
+
+func (f *stringsFlag) Set(s string) error {
+	*f = append(*f, s)
+	return nil
 }
 
 // usage prints the usage and quits.
 func usage() {
 	fmt.Printf("usage: %s command [arguments]\n", os.Args[0])
+	fmt.Printf("       %s -monorepo patterns [arguments]\n", os.Args[0])
+	fmt.Printf("       %s ctl [flags] command\n", os.Args[0])
 	flag.PrintDefaults()
 	os.Exit(1)
 }
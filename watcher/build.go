@@ -0,0 +1,72 @@
+package watcher
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"os/exec"
+	"time"
+)
+
+// build runs the build command, or the pipeline, copying its output as
+// the command's is and returning it, once there is room among the
+// builds run at once. It also returns whether the command changed,
+// which it always has unless the pipeline left its artefacts unchanged.
+func (s *Supervisor) build() ([]byte, bool, error) {
+	if s.builds != nil {
+		s.builds <- struct{}{}
+		defer func() { <-s.builds }()
+	}
+	var buf bytes.Buffer
+	stdout, stderr, flush := s.toolWriters(&buf)
+	defer flush()
+	if s.Pipeline != nil {
+		changed, err := s.Pipeline.run(s.Log, stdout, stderr)
+		return buf.Bytes(), changed, err
+	}
+	cmd := exec.Command(s.Build[0], s.Build[1:]...)
+	cmd.Stdout, cmd.Stderr = stdout, stderr
+	err := cmd.Run()
+	return buf.Bytes(), true, err
+}
+
+// toolWriters returns the writers which the output of the build and
+// tests is copied to: buf, and stdout and stderr formatted by Output and
+// kept by Tail, as the command's output is. flush writes any partial
+// line once the output is complete.
+func (s *Supervisor) toolWriters(buf *bytes.Buffer) (stdout, stderr io.Writer, flush func()) {
+	stdout, stderr, flush = os.Stdout, os.Stderr, func() {}
+	if s.Output != nil {
+		w1, w2 := s.Output.writers(os.Stdout, os.Stderr, time.Now())
+		stdout, stderr = w1, w2
+		flush = func() {
+			_ = w1.Close()
+			_ = w2.Close()
+		}
+	}
+	if s.Tail != nil {
+		stdout = io.MultiWriter(stdout, s.Tail.writer())
+		stderr = io.MultiWriter(stderr, s.Tail.writer())
+	}
+	return io.MultiWriter(stdout, buf), io.MultiWriter(stderr, buf), flush
+}
+
+// rebuild runs the build, reporting the result, and returns whether
+// the command changed.
+func (s *Supervisor) rebuild() (bool, error) {
+	started := time.Now()
+	output, changed, err := s.build()
+	e := Event{Err: err, Duration: time.Since(started), Output: output}
+	if err != nil {
+		wd, _ := os.Getwd()
+		e.Type = EventBuildFailed
+		e.Diagnostics = ParseDiagnostics(output, wd)
+		s.emit(LevelError, "build failed; waiting for changes...", e)
+		s.diagnose(e.Diagnostics)
+		return false, err
+	}
+	e.Type = EventBuilt
+	s.emit(LevelInfo, "build finished", e)
+	s.diagnose(nil)
+	return changed, nil
+}
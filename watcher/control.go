@@ -0,0 +1,331 @@
+package watcher
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Operations which may be requested of the supervisor's loop.
+const (
+	opRestart = "restart"
+	opStop    = "stop"
+	opStart   = "start"
+	opRebuild = "rebuild"
+)
+
+// request is an operation sent to the supervisor's loop, which replies
+// once it has been carried out.
+type request struct {
+	op    string
+	reply chan error
+}
+
+// Status describes the state of the supervised command.
+type Status struct {
+	// State is one of "starting", "running", "restarting", "exited",
+	// "stopped" or "build_failed".
+	State        string    `json:"state"`
+	Paused       bool      `json:"paused"`
+	PID          int       `json:"pid,omitempty"`
+	Ready        bool      `json:"ready"`
+	Restarts     int       `json:"restarts"`
+	StartedAt    time.Time `json:"started_at"`
+	Uptime       float64   `json:"uptime_seconds"`
+	LastExitCode int       `json:"last_exit_code"`
+	WatchEvents  int64     `json:"watch_events"`
+	WatchedFiles int       `json:"watched_files"`
+}
+
+// update applies the event to the status.
+func (st *Status) update(e Event) {
+	st.Restarts = e.Restarts
+	switch e.Type {
+	case EventStarted:
+		st.State, st.PID, st.Ready, st.StartedAt = "running", e.PID, false, e.Time
+	case EventReady:
+		st.Ready = true
+	case EventUnready:
+		st.Ready = false
+	case EventChanged, EventRestarting, EventUnhealthy:
+		if st.State == "running" {
+			st.State = "restarting"
+		}
+	case EventExited:
+		st.State, st.PID, st.Ready = "exited", 0, false
+		st.LastExitCode = e.ExitCode
+	case EventStopped:
+		st.State, st.PID, st.Ready = "stopped", 0, false
+	case EventBuildFailed:
+		st.State, st.PID, st.Ready = "build_failed", 0, false
+	case EventPaused:
+		st.Paused = true
+	case EventResumed:
+		st.Paused = false
+	}
+}
+
+// Status returns the current status of the command.
+func (s *Supervisor) Status() Status {
+	s.mu.Lock()
+	st := s.status
+	s.mu.Unlock()
+
+	if st.State == "" {
+		st.State = "starting"
+	}
+	if st.PID != 0 {
+		st.Uptime = time.Since(st.StartedAt).Seconds()
+	}
+	st.WatchEvents = atomic.LoadInt64(&s.watchEvents)
+	if s.watched != nil {
+		st.WatchedFiles = s.watched()
+	}
+	return st
+}
+
+// errFinished is returned for operations requested once the
+// supervisor's loop has returned.
+var errFinished = errors.New("supervisor is no longer running")
+
+// do asks the supervisor's loop to carry out the operation, giving up
+// with ctx's error once it is done, which the loop may be too busy
+// building or sleeping to notice. The operation may still be carried
+// out.
+func (s *Supervisor) do(ctx context.Context, op string) error {
+	req := request{op: op, reply: make(chan error, 1)}
+	select {
+	case s.requests <- req:
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-s.finished:
+		return errFinished
+	}
+	select {
+	case err := <-req.reply:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-s.finished:
+		return errFinished
+	}
+}
+
+// RestartCommand restarts the command, as if it had changed.
+func (s *Supervisor) RestartCommand() error {
+	return s.do(context.Background(), opRestart)
+}
+
+// StopCommand stops the command until StartCommand is called, without
+// exiting.
+func (s *Supervisor) StopCommand() error {
+	return s.do(context.Background(), opStop)
+}
+
+// StartCommand starts the command after StopCommand, or after its build
+// failed.
+func (s *Supervisor) StartCommand() error {
+	return s.do(context.Background(), opStart)
+}
+
+// Rebuild builds and restarts the command.
+func (s *Supervisor) Rebuild() error {
+	return s.do(context.Background(), opRebuild)
+}
+
+// Pause stops reacting to changes until Resume is called.
+func (s *Supervisor) Pause() {
+	s.mu.Lock()
+	paused := s.paused
+	s.paused = true
+	s.mu.Unlock()
+	if !paused {
+		s.emit(LevelInfo, "watching paused", Event{Type: EventPaused})
+	}
+}
+
+// Resume reacts to changes again, restarting the command once if
+// anything changed while paused.
+func (s *Supervisor) Resume() {
+	s.mu.Lock()
+	paused := s.paused
+	s.paused = false
+	s.mu.Unlock()
+	if !paused {
+		return
+	}
+	s.emit(LevelInfo, "watching resumed", Event{Type: EventResumed})
+	select {
+	case s.resumed <- struct{}{}:
+	default:
+	}
+}
+
+// Control serves an API controlling a Supervisor:
+//
+//	GET  /status              the Status, as JSON
+//	POST /restart             restart the command
+//	POST /stop                stop the command
+//	POST /start               start the command
+//	POST /pause               pause watching
+//	POST /resume              resume watching
+//	POST /rebuild             build and restart the command
+//	GET  /logs?lines=N&follow=true
+//	                          the last lines of output, optionally
+//	                          followed by new ones
+type Control struct {
+	s   *Supervisor
+	mux *http.ServeMux
+}
+
+// NewControl returns a Control for the given Supervisor.
+func NewControl(s *Supervisor) *Control {
+	c := &Control{s: s, mux: http.NewServeMux()}
+	c.mux.HandleFunc("/status", c.status)
+	c.mux.HandleFunc("/logs", c.logs)
+	ops := map[string]func(ctx context.Context) error{
+		"/restart": func(ctx context.Context) error { return s.do(ctx, opRestart) },
+		"/stop":    func(ctx context.Context) error { return s.do(ctx, opStop) },
+		"/start":   func(ctx context.Context) error { return s.do(ctx, opStart) },
+		"/rebuild": func(ctx context.Context) error { return s.do(ctx, opRebuild) },
+		"/pause":   func(context.Context) error { s.Pause(); return nil },
+		"/resume":  func(context.Context) error { s.Resume(); return nil },
+	}
+	for path, fn := range ops {
+		c.mux.HandleFunc(path, c.operation(fn))
+	}
+	return c
+}
+
+// ServeHTTP serves the API.
+func (c *Control) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	c.mux.ServeHTTP(w, r)
+}
+
+func (c *Control) status(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, c.s.Status())
+}
+
+// operation returns a handler which carries out fn, replying with the
+// resulting Status, or 503 if the supervisor's loop did not reply
+// before the request was cancelled or has returned.
+func (c *Control) operation(fn func(ctx context.Context) error) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			w.Header().Set("Allow", "POST")
+			writeJSON(w, http.StatusMethodNotAllowed, map[string]string{"error": "method not allowed"})
+			return
+		}
+		if err := fn(r.Context()); err != nil {
+			code := http.StatusConflict
+			if err == errFinished || r.Context().Err() != nil {
+				code = http.StatusServiceUnavailable
+			}
+			writeJSON(w, code, map[string]string{"error": err.Error()})
+			return
+		}
+		writeJSON(w, http.StatusOK, c.s.Status())
+	}
+}
+
+func (c *Control) logs(w http.ResponseWriter, r *http.Request) {
+	t := c.s.Tail
+	if t == nil {
+		http.Error(w, "output is not being kept", http.StatusNotFound)
+		return
+	}
+	n, err := strconv.Atoi(r.URL.Query().Get("lines"))
+	if err != nil {
+		n = 100
+	}
+	if n < 0 {
+		http.Error(w, "lines must not be negative", http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	follow := r.URL.Query().Get("follow") == "true"
+	lines, next, cancel := t.follow(n, follow)
+	defer cancel()
+	for _, line := range lines {
+		fmt.Fprint(w, line)
+	}
+	if !follow {
+		return
+	}
+
+	flusher, _ := w.(http.Flusher)
+	for {
+		if flusher != nil {
+			flusher.Flush()
+		}
+		select {
+		case line := <-next:
+			fmt.Fprint(w, line)
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+// writeJSON writes v as the JSON response.
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+// ControlAddr returns the network and address for the given control
+// address, which is either host:port, served over HTTP on localhost if
+// the host is empty, or the path to a Unix socket.
+func ControlAddr(addr string) (network, address string) {
+	if _, port, err := net.SplitHostPort(addr); err == nil && !strings.Contains(addr, "/") {
+		if strings.HasPrefix(addr, ":") {
+			addr = "127.0.0.1:" + port
+		}
+		return "tcp", addr
+	}
+	return "unix", addr
+}
+
+// ListenControl listens on the given control address. A stale Unix
+// socket is replaced, and a new one is only accessible by its owner. A
+// TCP address must be on the loopback interface, as the API is not
+// authenticated.
+func ListenControl(addr string) (net.Listener, error) {
+	network, address := ControlAddr(addr)
+	if network == "tcp" {
+		host, _, _ := net.SplitHostPort(address)
+		if ip := net.ParseIP(host); host != "localhost" && (ip == nil || !ip.IsLoopback()) {
+			return nil, errors.Errorf("control address %s is not on localhost", address)
+		}
+	}
+	if network == "unix" {
+		if info, err := os.Stat(address); err == nil && info.Mode()&os.ModeSocket != 0 {
+			if _, err := net.Dial("unix", address); err == nil {
+				return nil, errors.Errorf("%s is already in use", address)
+			}
+			_ = os.Remove(address)
+		}
+	}
+	l, err := net.Listen(network, address)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to listen for control")
+	}
+	if network == "unix" {
+		if err := os.Chmod(address, 0600); err != nil {
+			l.Close()
+			return nil, err
+		}
+	}
+	return l, nil
+}
@@ -0,0 +1,21 @@
+//go:build !darwin && !dragonfly && !freebsd && !linux && !netbsd && !openbsd
+// +build !darwin,!dragonfly,!freebsd,!linux,!netbsd,!openbsd
+
+package watcher
+
+import (
+	"os/exec"
+
+	"github.com/pkg/errors"
+)
+
+// credential is unused on this platform.
+type credential struct{}
+
+// RunAs is not supported on this platform.
+func (s *Supervisor) RunAs(username, group string, groups []string) error {
+	return errors.New("changing the user of the command is not supported on this platform")
+}
+
+// setCredential does nothing on this platform.
+func (s *Supervisor) setCredential(cmd *exec.Cmd) {}
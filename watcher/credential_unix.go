@@ -0,0 +1,104 @@
+//go:build darwin || dragonfly || freebsd || linux || netbsd || openbsd
+// +build darwin dragonfly freebsd linux netbsd openbsd
+
+package watcher
+
+import (
+	"os"
+	"os/exec"
+	"os/user"
+	"strconv"
+	"syscall"
+
+	"github.com/pkg/errors"
+)
+
+// credential is the user and groups to run the command as.
+type credential = syscall.Credential
+
+// RunAs runs the command as the given user, which may be a name or a
+// uid, or the supervisor's own user if it is empty. The command's group
+// is the given group, or else the user's primary group, and its
+// supplementary groups are the given groups, or else the user's.
+//
+// Changing the user requires the supervisor to run as root, which also
+// keeps it able to signal the command.
+func (s *Supervisor) RunAs(username, group string, groups []string) error {
+	uid, gid := os.Getuid(), os.Getgid()
+	changeGroups := len(groups) > 0
+	if username != "" {
+		u, err := user.Lookup(username)
+		if _, ok := err.(user.UnknownUserError); ok && isID(username) {
+			u, err = user.LookupId(username)
+		}
+		if err != nil {
+			return errors.Wrapf(err, "failed to look up user %q", username)
+		}
+		if uid, err = strconv.Atoi(u.Uid); err != nil {
+			return errors.Wrapf(err, "invalid uid for user %q", username)
+		}
+		if gid, err = strconv.Atoi(u.Gid); err != nil {
+			return errors.Wrapf(err, "invalid gid for user %q", username)
+		}
+		if groups == nil {
+			if groups, err = u.GroupIds(); err != nil {
+				return errors.Wrapf(err, "failed to look up groups of user %q", username)
+			}
+		}
+	}
+	if group != "" {
+		var err error
+		if gid, err = lookupGroup(group); err != nil {
+			return err
+		}
+	}
+
+	cred := &credential{Uid: uint32(uid), Gid: uint32(gid)}
+	for _, g := range groups {
+		id, err := lookupGroup(g)
+		if err != nil {
+			return err
+		}
+		cred.Groups = append(cred.Groups, uint32(id))
+	}
+
+	if os.Geteuid() != 0 {
+		if uid == os.Getuid() && gid == os.Getgid() && !changeGroups {
+			return nil
+		}
+		return errors.New("must run as root to change the user or groups of the command")
+	}
+	s.credential = cred
+	return nil
+}
+
+// lookupGroup returns the gid of the given group, which may be a name or
+// a gid.
+func lookupGroup(name string) (int, error) {
+	g, err := user.LookupGroup(name)
+	if _, ok := err.(user.UnknownGroupError); ok && isID(name) {
+		g, err = user.LookupGroupId(name)
+	}
+	if err != nil {
+		return 0, errors.Wrapf(err, "failed to look up group %q", name)
+	}
+	gid, err := strconv.Atoi(g.Gid)
+	if err != nil {
+		return 0, errors.Wrapf(err, "invalid gid for group %q", name)
+	}
+	return gid, nil
+}
+
+// setCredential configures cmd to run with the credential from RunAs,
+// if any.
+func (s *Supervisor) setCredential(cmd *exec.Cmd) {
+	if s.credential != nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{Credential: s.credential}
+	}
+}
+
+// isID returns whether the user or group name is a numeric id.
+func isID(name string) bool {
+	_, err := strconv.Atoi(name)
+	return err == nil
+}
@@ -0,0 +1,114 @@
+package watcher
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// A Diagnostic is an error which the compiler reported at a position in
+// a file.
+type Diagnostic struct {
+	File    string `json:"file"`
+	Line    int    `json:"line"`
+	Column  int    `json:"column,omitempty"`
+	Message string `json:"message"`
+}
+
+// String returns the diagnostic on one line, as file:line:column:
+// message.
+func (d Diagnostic) String() string {
+	pos := d.File + ":" + strconv.Itoa(d.Line)
+	if d.Column != 0 {
+		pos += ":" + strconv.Itoa(d.Column)
+	}
+	return pos + ": " + strings.Replace(d.Message, "\n", "; ", -1)
+}
+
+// Diagnostics are the errors of a build. They are written as their
+// number in text logs, and in full in JSON.
+type Diagnostics []Diagnostic
+
+// String returns the number of diagnostics.
+func (ds Diagnostics) String() string {
+	return strconv.Itoa(len(ds))
+}
+
+// diagnosticPattern matches the first line of an error from the Go
+// toolchain, such as "./main.go:10:2: undefined: x".
+var diagnosticPattern = regexp.MustCompile(`^(\S[^:]*):(\d+)(?::(\d+))?: (.*)$`)
+
+// ParseDiagnostics returns the errors in the output of go build, with
+// their files made absolute relative to dir. Indented lines following
+// an error continue its message, and package headers are skipped.
+func ParseDiagnostics(output []byte, dir string) Diagnostics {
+	var ds Diagnostics
+	scanner := bufio.NewScanner(bytes.NewReader(output))
+	for scanner.Scan() {
+		line := scanner.Text()
+		if strings.HasPrefix(line, "\t") && len(ds) > 0 {
+			d := &ds[len(ds)-1]
+			d.Message += "\n" + strings.TrimSpace(line)
+			continue
+		}
+		m := diagnosticPattern.FindStringSubmatch(line)
+		if m == nil {
+			continue
+		}
+		d := Diagnostic{File: m[1], Message: m[4]}
+		d.Line, _ = strconv.Atoi(m[2])
+		d.Column, _ = strconv.Atoi(m[3])
+		if !filepath.IsAbs(d.File) {
+			d.File = filepath.Join(dir, d.File)
+		}
+		ds = append(ds, d)
+	}
+	return ds
+}
+
+// maxSummary is the number of diagnostics listed after a failed build.
+const maxSummary = 10
+
+// diagnose writes the diagnostics of a build to the quickfix file, if
+// set, emptying it if there are none, and lists the first few of them
+// on the terminal unless logging JSON, in which case they are in the
+// event. Their files are listed relative to the working directory.
+func (s *Supervisor) diagnose(ds Diagnostics) {
+	if s.Quickfix != "" {
+		var buf bytes.Buffer
+		for _, d := range ds {
+			buf.WriteString(d.String() + "\n")
+		}
+		if err := ioutil.WriteFile(s.Quickfix, buf.Bytes(), 0644); err != nil {
+			s.Log.Warn("failed to write quickfix file", Fields{"error": err.Error()})
+		}
+	}
+	if len(ds) == 0 || s.Log.JSON {
+		return
+	}
+
+	wd, _ := os.Getwd()
+	var buf bytes.Buffer
+	if len(ds) == 1 {
+		buf.WriteString("1 build error:\n")
+	} else {
+		fmt.Fprintf(&buf, "%d build errors:\n", len(ds))
+	}
+	for i, d := range ds {
+		if i == maxSummary {
+			fmt.Fprintf(&buf, "  and %d more\n", len(ds)-maxSummary)
+			break
+		}
+		if rel, err := filepath.Rel(wd, d.File); err == nil && !strings.HasPrefix(rel, "..") {
+			d.File = rel
+		}
+		buf.WriteString("  " + d.String() + "\n")
+	}
+	s.Log.write(buf.Bytes())
+}
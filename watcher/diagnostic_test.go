@@ -0,0 +1,65 @@
+package watcher
+
+import (
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestParseDiagnostics(t *testing.T) {
+	dir := filepath.FromSlash("/src/app")
+	tests := []struct {
+		name   string
+		output string
+		want   Diagnostics
+	}{
+		{
+			name:   "none",
+			output: "",
+		},
+		{
+			name:   "line and column",
+			output: "# example.com/app\n./main.go:10:2: undefined: x\n",
+			want: Diagnostics{
+				{File: filepath.Join(dir, "main.go"), Line: 10, Column: 2, Message: "undefined: x"},
+			},
+		},
+		{
+			name:   "line only",
+			output: "cmd/server/main.go:3: syntax error: unexpected newline\n",
+			want: Diagnostics{
+				{File: filepath.Join(dir, "cmd/server/main.go"), Line: 3, Message: "syntax error: unexpected newline"},
+			},
+		},
+		{
+			name:   "absolute file",
+			output: "/tmp/x.go:1:1: expected 'package', found 'EOF'\n",
+			want: Diagnostics{
+				{File: "/tmp/x.go", Line: 1, Column: 1, Message: "expected 'package', found 'EOF'"},
+			},
+		},
+		{
+			name: "continued message",
+			output: "./main.go:7:9: cannot use s (type string) as type int in return argument\n" +
+				"\thave (string)\n" +
+				"\twant (int)\n" +
+				"./main.go:12:1: missing return\n",
+			want: Diagnostics{
+				{File: filepath.Join(dir, "main.go"), Line: 7, Column: 9, Message: "cannot use s (type string) as type int in return argument\nhave (string)\nwant (int)"},
+				{File: filepath.Join(dir, "main.go"), Line: 12, Column: 1, Message: "missing return"},
+			},
+		},
+		{
+			name:   "other output",
+			output: "\tindented before any error\ngo: downloading example.com/dep v1.0.0\nnote: module requires Go 1.21\n",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got := ParseDiagnostics([]byte(test.output), dir)
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("ParseDiagnostics() = %#v, want %#v", got, test.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,165 @@
+package watcher
+
+import (
+	"strings"
+	"time"
+)
+
+// EventType describes a change in the state of the supervised command.
+type EventType string
+
+// Event types.
+const (
+	EventStarted     EventType = "started"
+	EventChanged     EventType = "changed"
+	EventExited      EventType = "exited"
+	EventReady       EventType = "ready"
+	EventUnready     EventType = "unready"
+	EventUnhealthy   EventType = "unhealthy"
+	EventBuilt       EventType = "built"
+	EventBuildFailed EventType = "build_failed"
+	EventRestarting  EventType = "restarting"
+	EventStopped     EventType = "stopped"
+	EventPaused      EventType = "paused"
+	EventResumed     EventType = "resumed"
+	EventHookFailed  EventType = "hook_failed"
+	EventAction      EventType = "action"
+	EventTested      EventType = "tested"
+	EventTestsFailed EventType = "tests_failed"
+)
+
+// Reasons for starting a generation of the command.
+const (
+	ReasonStart  = "start"
+	ReasonChange = "file_change"
+	ReasonCrash  = "crash"
+	ReasonSIGBUS = "sigbus"
+	ReasonHealth = "health_failure"
+	ReasonManual = "manual"
+)
+
+// An Event is sent to subscribers whenever the supervised command
+// changes state.
+type Event struct {
+	Type     EventType
+	Time     time.Time
+	PID      int
+	Path     string
+	Err      error
+	ExitCode int
+	Signal   string
+	Restarts int
+
+	// Reason is why the command was started, for EventStarted.
+	Reason string
+
+	// Uptime is how long the command had been running, for events
+	// which stop it.
+	Uptime time.Duration
+
+	// Duration is how long the command took to become ready, or how
+	// long the build took.
+	Duration time.Duration
+
+	// Output is the build output, for EventBuildFailed.
+	Output []byte
+
+	// Diagnostics are the errors parsed from the Output, for
+	// EventBuildFailed.
+	Diagnostics Diagnostics
+
+	// Packages are the packages which passed, for EventTested, or
+	// failed, for EventTestsFailed.
+	Packages []string
+
+	// Hook is the name of the hook, for EventHookFailed.
+	Hook string
+
+	// Action is the action taken instead of a restart, for
+	// EventAction.
+	Action string
+
+	// Service is the name of the binary, when a Monorepo supervises
+	// several.
+	Service string
+}
+
+// fields returns the fields describing the event in the log.
+func (e Event) fields() Fields {
+	f := Fields{
+		"event":    string(e.Type),
+		"restarts": e.Restarts,
+	}
+	if e.Service != "" {
+		f["service"] = e.Service
+	}
+	if e.PID != 0 {
+		f["pid"] = e.PID
+	}
+	if e.Path != "" {
+		f["path"] = e.Path
+	}
+	if e.Err != nil {
+		f["error"] = e.Err.Error()
+	}
+	if e.Type == EventExited {
+		f["exit_code"] = e.ExitCode
+	}
+	if e.Reason != "" {
+		f["reason"] = e.Reason
+	}
+	if e.Signal != "" {
+		f["signal"] = e.Signal
+	}
+	if e.Uptime != 0 {
+		f["uptime"] = e.Uptime
+	}
+	if e.Duration != 0 {
+		f["duration"] = e.Duration
+	}
+	if e.Hook != "" {
+		f["hook"] = e.Hook
+	}
+	if e.Action != "" {
+		f["action"] = e.Action
+	}
+	if len(e.Diagnostics) > 0 {
+		f["diagnostics"] = e.Diagnostics
+	}
+	if len(e.Packages) > 0 {
+		f["packages"] = strings.Join(e.Packages, ",")
+	}
+	return f
+}
+
+// Subscribe returns a channel which receives every subsequent Event.
+// Events are dropped rather than block the supervisor if the channel
+// is full.
+func (s *Supervisor) Subscribe() <-chan Event {
+	c := make(chan Event, 64)
+	s.mu.Lock()
+	s.subscribers = append(s.subscribers, c)
+	s.mu.Unlock()
+	return c
+}
+
+// emit logs the event with the given message, then sends it to every
+// subscriber without blocking.
+func (s *Supervisor) emit(level Level, msg string, e Event) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	e.Time = time.Now()
+	e.Service = s.name
+	if s.generation > 1 {
+		e.Restarts = s.generation - 1
+	}
+	s.status.update(e)
+	s.Log.Log(level, msg, e.fields())
+	for _, c := range s.subscribers {
+		select {
+		case c <- e:
+		default:
+		}
+	}
+}
@@ -0,0 +1,186 @@
+package watcher
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// Fanotify watches whole filesystems, or mounts on older kernels, using
+// Linux's fanotify, keeping only the events for files under the watched
+// paths. Unlike Notifier, directories are watched recursively without
+// a watch for each of them. Only writes are reported, as fanotify does
+// not report files which are removed or renamed unless it identifies
+// them by file handle. It requires CAP_SYS_ADMIN.
+//
+// Deprecated: please use github.com/cosmtrek/air or another tool instead.
+type Fanotify struct {
+	Supervisor
+	fd int
+
+	mu    sync.Mutex // protects the following
+	roots []string
+	files map[string]int // the number of files under each root when added
+
+	changes chan string
+	errs    chan error
+	closed  chan struct{}
+	close   sync.Once
+}
+
+// NewFanotify returns a Fanotify with the given parameters, returning
+// an error if fanotify is unsupported or not permitted.
+//
+// Deprecated: please use github.com/cosmtrek/air or another tool instead.
+func NewFanotify(autorestart bool, interval int, cmd string, args []string) (*Fanotify, error) {
+	fd, err := fanotifyInit()
+	if err != nil {
+		return nil, err
+	}
+	f := &Fanotify{
+		Supervisor: newSupervisor(autorestart, interval, cmd, args),
+		fd:         fd,
+		files:      make(map[string]int),
+		changes:    make(chan string),
+		errs:       make(chan error),
+		closed:     make(chan struct{}),
+	}
+	f.watched = func() int {
+		f.mu.Lock()
+		defer f.mu.Unlock()
+		// A root under another is counted with it.
+		n := 0
+		for i, root := range f.roots {
+			nested := false
+			for j, other := range f.roots {
+				if j < i && root == other || root != other && within(root, other) {
+					nested = true
+				}
+			}
+			if !nested {
+				n += f.files[root]
+			}
+		}
+		return n
+	}
+	return f, nil
+}
+
+// Add watches everything under the given path, marking the filesystem
+// which it is on.
+//
+// Deprecated: please use github.com/cosmtrek/air or another tool instead.
+func (f *Fanotify) Add(path string) error {
+	abs, err := filepath.Abs(path)
+	if err == nil {
+		abs, err = filepath.EvalSymlinks(abs)
+	}
+	if err == nil {
+		err = fanotifyMark(f.fd, abs)
+	}
+	if err != nil {
+		return errors.Wrapf(err, "failed to add path %s", path)
+	}
+	files := countFiles(abs)
+	f.mu.Lock()
+	f.roots = append(f.roots, abs)
+	f.files[abs] = files
+	f.mu.Unlock()
+	return nil
+}
+
+// countFiles returns the number of files and directories under the
+// given path, including itself, for the status. Those which cannot be
+// read are left out.
+func countFiles(path string) int {
+	n := 0
+	_ = filepath.Walk(path, func(_ string, _ os.FileInfo, err error) error {
+		if err == nil {
+			n++
+		}
+		return nil
+	})
+	return n
+}
+
+// Remove stops reporting changes under the given path. The filesystem
+// stays marked, as other paths may be on it.
+//
+// Deprecated: please use github.com/cosmtrek/air or another tool instead.
+func (f *Fanotify) Remove(path string) error {
+	abs, err := filepath.Abs(path)
+	if err == nil {
+		abs, err = filepath.EvalSymlinks(abs)
+	}
+	if err != nil {
+		return errors.Wrapf(err, "failed to remove path %s", path)
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for i, root := range f.roots {
+		if root == abs {
+			f.roots = append(f.roots[:i:i], f.roots[i+1:]...)
+			if !contains(f.roots, abs) {
+				delete(f.files, abs)
+			}
+			return nil
+		}
+	}
+	return errors.Errorf("failed to remove path %s: not watched", path)
+}
+
+// under returns whether the path is one of the watched paths, or under
+// one of them.
+func (f *Fanotify) under(path string) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for _, root := range f.roots {
+		if within(path, root) {
+			return true
+		}
+	}
+	return false
+}
+
+// within returns whether the path is the root or under it.
+func within(path, root string) bool {
+	return path == root || strings.HasPrefix(path, strings.TrimSuffix(root, "/")+"/")
+}
+
+// source returns the channels which changes and errors are forwarded
+// on once started.
+func (f *Fanotify) source() (<-chan string, <-chan error, <-chan struct{}) {
+	return f.changes, f.errs, f.closed
+}
+
+// Deprecated: please use github.com/cosmtrek/air or another tool instead.
+func (f *Fanotify) Watch() {
+	f.supervise(f.source())
+}
+
+// Start reads events until the watcher is closed.
+//
+// Deprecated: please use github.com/cosmtrek/air or another tool instead.
+func (f *Fanotify) Start() error {
+	return errors.Wrap(f.read(), "fanotify")
+}
+
+// Deprecated: please use github.com/cosmtrek/air or another tool instead.
+func (f *Fanotify) Close() error {
+	f.close.Do(func() { close(f.closed) })
+	return nil
+}
+
+// send forwards the changed path, returning false if the watcher was
+// closed first.
+func (f *Fanotify) send(path string) bool {
+	select {
+	case f.changes <- path:
+		return true
+	case <-f.closed:
+		return false
+	}
+}
@@ -0,0 +1,160 @@
+package watcher
+
+import (
+	"os"
+	"strconv"
+	"syscall"
+	"unsafe"
+
+	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+)
+
+// fanotify's constants, which golang.org/x/sys/unix does not define.
+const (
+	fanClassNotif      = 0x0
+	fanCloexec         = 0x1
+	fanMarkAdd         = 0x1
+	fanMarkMount       = 0x10
+	fanMarkFilesystem  = 0x100
+	fanCloseWrite      = 0x8
+	fanQueueOverflow   = 0x4000
+	fanMetadataVersion = 3
+)
+
+// fanotifyEventMetadata is struct fanotify_event_metadata.
+type fanotifyEventMetadata struct {
+	EventLen    uint32
+	Vers        uint8
+	Reserved    uint8
+	MetadataLen uint16
+	Mask        uint64
+	Fd          int32
+	Pid         int32
+}
+
+// fanotifyInit returns a new fanotify file descriptor.
+func fanotifyInit() (int, error) {
+	fd, _, errno := unix.Syscall(unix.SYS_FANOTIFY_INIT,
+		fanClassNotif|fanCloexec,
+		unix.O_RDONLY|unix.O_LARGEFILE|unix.O_CLOEXEC,
+		0)
+	if errno == unix.EPERM {
+		return 0, errors.New("fanotify requires CAP_SYS_ADMIN")
+	}
+	if errno != 0 {
+		return 0, errors.Wrap(errno, "fanotify_init")
+	}
+	return int(fd), nil
+}
+
+// fanotifyMark marks the filesystem containing path for writes,
+// falling back to its mount on kernels older than 4.20.
+func fanotifyMark(fd int, path string) error {
+	err := fanotifyMarkFlags(fd, fanMarkAdd|fanMarkFilesystem, path)
+	if err == unix.EINVAL {
+		err = fanotifyMarkFlags(fd, fanMarkAdd|fanMarkMount, path)
+	}
+	if err != nil {
+		return errors.Wrap(err, "fanotify_mark")
+	}
+	return nil
+}
+
+// fanotifyMarkFlags calls fanotify_mark, whose 64-bit mask takes two
+// arguments on 32-bit platforms.
+func fanotifyMarkFlags(fd int, flags uint, path string) error {
+	p, err := unix.BytePtrFromString(path)
+	if err != nil {
+		return err
+	}
+	var (
+		mask  uint64 = fanCloseWrite
+		dirfd        = unix.AT_FDCWD
+		errno syscall.Errno
+	)
+	if unsafe.Sizeof(uintptr(0)) == 8 {
+		_, _, errno = unix.Syscall6(unix.SYS_FANOTIFY_MARK,
+			uintptr(fd), uintptr(flags), uintptr(mask),
+			uintptr(dirfd), uintptr(unsafe.Pointer(p)), 0)
+	} else {
+		_, _, errno = unix.Syscall6(unix.SYS_FANOTIFY_MARK,
+			uintptr(fd), uintptr(flags), uintptr(mask), uintptr(mask>>32),
+			uintptr(dirfd), uintptr(unsafe.Pointer(p)))
+	}
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+// read forwards the paths of files written under the watched paths
+// until the watcher is closed, ignoring those written by the
+// supervisor itself. If events were lost, the first watched path is
+// reported as changed, if there is one.
+func (f *Fanotify) read() error {
+	defer unix.Close(f.fd)
+
+	var (
+		buf  = make([]byte, 64*1024)
+		fds  = []unix.PollFd{{Fd: int32(f.fd), Events: unix.POLLIN}}
+		self = int32(os.Getpid())
+		meta fanotifyEventMetadata
+	)
+	for {
+		select {
+		case <-f.closed:
+			return nil
+		default:
+		}
+
+		// Poll with a timeout, so that Close is noticed.
+		n, err := unix.Poll(fds, 250)
+		if err == unix.EINTR || n == 0 {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		n, err = unix.Read(f.fd, buf)
+		if err == unix.EINTR || err == unix.EAGAIN {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+
+		for off := 0; off+int(unsafe.Sizeof(meta)) <= n; off += int(meta.EventLen) {
+			meta = *(*fanotifyEventMetadata)(unsafe.Pointer(&buf[off]))
+			if meta.Vers != fanMetadataVersion {
+				return errors.Errorf("unsupported metadata version %d", meta.Vers)
+			}
+			if meta.EventLen == 0 {
+				break
+			}
+			if meta.Mask&fanQueueOverflow != 0 {
+				f.mu.Lock()
+				var root string
+				if len(f.roots) > 0 {
+					root = f.roots[0]
+				}
+				f.mu.Unlock()
+				if root != "" && !f.send(root) {
+					return nil
+				}
+				continue
+			}
+			if meta.Fd < 0 {
+				continue
+			}
+			path, err := os.Readlink("/proc/self/fd/" + strconv.Itoa(int(meta.Fd)))
+			unix.Close(int(meta.Fd))
+			if err != nil || meta.Pid == self || !f.under(path) || f.Ops&(OpCreate|OpWrite) == 0 {
+				continue
+			}
+			if !f.send(path) {
+				return nil
+			}
+		}
+	}
+}
@@ -0,0 +1,24 @@
+//go:build !linux
+// +build !linux
+
+package watcher
+
+import (
+	"github.com/pkg/errors"
+)
+
+// fanotifyInit returns an error, as fanotify is only supported on
+// Linux.
+func fanotifyInit() (int, error) {
+	return 0, errors.New("fanotify is only supported on Linux")
+}
+
+// fanotifyMark is not supported on this platform.
+func fanotifyMark(fd int, path string) error {
+	return errors.New("fanotify is only supported on Linux")
+}
+
+// read does nothing on this platform.
+func (f *Fanotify) read() error {
+	return nil
+}
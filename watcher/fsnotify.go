@@ -1,10 +1,8 @@
 package watcher
 
 import (
-	"os"
-	"os/exec"
-	"syscall"
-	"time"
+	"path/filepath"
+	"sync"
 
 	"github.com/fsnotify/fsnotify"
 	"github.com/pkg/errors"
@@ -12,13 +10,13 @@ import (
 
 // Deprecated: pluease use github.com/cosmtrek/air or another tool instead.
 type Notifier struct {
-	Autorestart bool
-	Interval    time.Duration
-	Cmd         string
-	Args        []string
-	bin         *exec.Cmd
-	watcher     *fsnotify.Watcher
-	done        chan struct{}
+	Supervisor
+	watcher *fsnotify.Watcher
+	done    chan struct{}
+	close   sync.Once
+
+	mu      sync.Mutex          // protects entries
+	entries map[string][]string // each watched path and its entries when added
 }
 
 // NewNotifier returns a Notifier with the given parameters, using
@@ -26,90 +24,107 @@ type Notifier struct {
 //
 // Deprecated: please use github.com/cosmtrek/air or another tool instead.
 func NewNotifier(autorestart bool, interval int, cmd string, args []string) (*Notifier, error) {
-	if interval == 0 {
-		interval = 250
-	}
-
 	w, err := fsnotify.NewWatcher()
 	if err != nil {
 		return nil, err
 	}
-	return &Notifier{
-		Autorestart: autorestart,
-		Interval:    time.Duration(interval) * time.Millisecond,
-		Cmd:         cmd,
-		Args:        args,
-		watcher:     w,
-	}, nil
+	n := &Notifier{
+		Supervisor: newSupervisor(autorestart, interval, cmd, args),
+		watcher:    w,
+		done:       make(chan struct{}),
+		entries:    make(map[string][]string),
+	}
+	n.watched = func() int {
+		n.mu.Lock()
+		defer n.mu.Unlock()
+		seen := make(map[string]bool)
+		for _, paths := range n.entries {
+			for _, path := range paths {
+				seen[path] = true
+			}
+		}
+		return len(seen)
+	}
+	return n, nil
 }
 
 // Add returns an error if the given path is invalid.
 //
 // Deprecated: please use github.com/cosmtrek/air or another tool instead.
 func (n *Notifier) Add(path string) error {
-	return errors.Wrapf(n.watcher.Add(path), "failed to add path %s", path)
+	if err := n.watcher.Add(path); err != nil {
+		return errors.Wrapf(err, "failed to add path %s", path)
+	}
+	entries := withEntries(path)
+	n.mu.Lock()
+	n.entries[filepath.Clean(path)] = entries
+	n.mu.Unlock()
+	return nil
 }
 
-// sleep blocks for the given duration.
-func (n *Notifier) sleep(d time.Duration, events chan fsnotify.Event) {
-	timer := time.After(d)
-	for {
-		select {
-		case <-events:
-		case <-timer:
-			return
-		}
+// withEntries returns the path and, if it is a directory, the paths of
+// its entries, which are watched along with it.
+func withEntries(path string) []string {
+	path = filepath.Clean(path)
+	names, _ := readDirNames(path)
+	paths := []string{path}
+	for _, name := range names {
+		paths = append(paths, filepath.Join(path, name))
 	}
+	return paths
 }
 
+// Remove stops watching the given path.
+//
 // Deprecated: please use github.com/cosmtrek/air or another tool instead.
-func (n *Notifier) Watch() {
-	for {
-		n.bin = exec.Command(n.Cmd, n.Args...)
-		n.bin.Stdout = os.Stdout
-		n.bin.Stderr = os.Stderr
-		n.bin.Stdin = os.Stdin
-		must(n.bin.Start(), "bin.Start()")
-
-		// Watch for exit.
-		exited := make(chan error)
-		go func() {
-			exited <- n.bin.Wait()
-		}()
+func (n *Notifier) Remove(path string) error {
+	if err := n.watcher.Remove(path); err != nil {
+		return errors.Wrapf(err, "failed to remove path %s", path)
+	}
+	n.mu.Lock()
+	delete(n.entries, filepath.Clean(path))
+	n.mu.Unlock()
+	return nil
+}
 
+// events forwards fsnotify's events and errors until it is closed.
+func (n *Notifier) events(changes chan<- string, errs chan<- error, closed chan<- struct{}) {
+	defer close(closed)
+	for {
 		select {
-		case <-n.watcher.Events:
-			_ = kill(n.bin, "executable changed; reloading...")
-			n.sleep(n.Interval, n.watcher.Events)
-		case err := <-n.watcher.Errors:
-			must(err, "error while polling files")
-		case err := <-exited:
-			var exitCode int
-			if err, ok := err.(*exec.ExitError); ok {
-				if n.Autorestart {
-					_ = kill(n.bin, "executable quit; reloading...")
-					n.sleep(n.Interval, n.watcher.Events)
-					continue
-				}
-				if status, ok := err.Sys().(syscall.WaitStatus); ok {
-					// Retry on bus error, as these are occasionally
-					// encountered when restarting a binary hosted on a
-					// docker volume.
-					if status.Signal() == syscall.SIGBUS {
-						_ = kill(n.bin, "retrying on bus error...")
-						n.sleep(n.Interval, n.watcher.Events)
-						continue
-					}
-					exitCode = status.ExitStatus()
-				} else {
-					exitCode = 1
-				}
+		case e, ok := <-n.watcher.Events:
+			if !ok {
+				return
+			}
+			if n.Ops.fsnotify(e.Op) {
+				changes <- e.Name
 			}
-			os.Exit(exitCode)
+		case err, ok := <-n.watcher.Errors:
+			if !ok {
+				return
+			}
+			errs <- err
 		}
 	}
 }
 
+// source starts forwarding fsnotify's events and errors, returning
+// the channels which they are forwarded on.
+func (n *Notifier) source() (<-chan string, <-chan error, <-chan struct{}) {
+	var (
+		changes = make(chan string)
+		errs    = make(chan error)
+		closed  = make(chan struct{})
+	)
+	go n.events(changes, errs, closed)
+	return changes, errs, closed
+}
+
+// Deprecated: please use github.com/cosmtrek/air or another tool instead.
+func (n *Notifier) Watch() {
+	n.supervise(n.source())
+}
+
 // Deprecated: please use github.com/cosmtrek/air or another tool instead.
 func (n *Notifier) Start() error {
 	for range n.done {
@@ -121,5 +136,6 @@ func (n *Notifier) Start() error {
 // Deprecated: please use github.com/cosmtrek/air or another tool instead.
 func (n *Notifier) Close() error {
 	n.watcher.Close()
+	n.close.Do(func() { close(n.done) })
 	return nil
 }
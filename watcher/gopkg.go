@@ -0,0 +1,264 @@
+package watcher
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// GoPackages keeps a Watcher watching the files which a Go binary is
+// built from: the source, cgo and embedded files of the packages in its
+// module, along with go.mod and go.sum. The directories of the files
+// are watched, so that new files and files replaced by renaming are
+// seen, and changes to other files under them are ignored. The files
+// are listed again whenever a Go file or go.mod changes, as imports may
+// have changed with it.
+type GoPackages struct {
+	// Patterns are the packages of the binary, such as "./cmd/api".
+	Patterns []string
+
+	w   Watcher
+	log *Logger
+
+	mu      sync.Mutex      // protects the following
+	watched map[string]bool // the watched directories
+	files   map[string]bool // the files which the binary is built from
+}
+
+// goPackage is the part of the output of go list which is watched.
+type goPackage struct {
+	Dir        string
+	ImportPath string
+	Name       string
+	Standard   bool
+	DepOnly    bool
+	Deps       []string
+	Module     *struct {
+		Main  bool
+		GoMod string
+	}
+
+	GoFiles    []string
+	CgoFiles   []string
+	CFiles     []string
+	CXXFiles   []string
+	HFiles     []string
+	SFiles     []string
+	SysoFiles  []string
+	EmbedFiles []string
+}
+
+// NewGoPackages returns GoPackages adding the files of the given
+// packages to w, and logging to log.
+func NewGoPackages(w Watcher, log *Logger, patterns []string) *GoPackages {
+	return &GoPackages{
+		Patterns: patterns,
+		w:        w,
+		log:      log,
+		watched:  make(map[string]bool),
+		files:    make(map[string]bool),
+	}
+}
+
+// Files returns the files which the binary is built from, using go
+// list.
+func (g *GoPackages) Files() ([]string, error) {
+	pkgs, err := listGoPackages(g.Patterns)
+	if err != nil {
+		return nil, err
+	}
+	seen := make(map[string]bool)
+	for _, pkg := range pkgs {
+		for _, path := range pkg.files() {
+			seen[path] = true
+		}
+	}
+	files := make([]string, 0, len(seen))
+	for path := range seen {
+		files = append(files, path)
+	}
+	sort.Strings(files)
+	return files, nil
+}
+
+// listGoPackages returns the packages matching the given patterns, and
+// their dependencies, which are in the main module.
+func listGoPackages(patterns []string) ([]*goPackage, error) {
+	var stdout, stderr bytes.Buffer
+	cmd := exec.Command("go", append([]string{"list", "-deps", "-json", "-e"}, patterns...)...)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return nil, errors.Wrapf(err, "go list: %s", strings.TrimSpace(stderr.String()))
+	}
+
+	var pkgs []*goPackage
+	modules := false
+	for dec := json.NewDecoder(&stdout); ; {
+		pkg := new(goPackage)
+		if err := dec.Decode(pkg); err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, errors.Wrap(err, "failed to read go list")
+		}
+		modules = modules || pkg.Module != nil
+		pkgs = append(pkgs, pkg)
+	}
+
+	// Without modules, packages outside the standard library and
+	// vendor directories are the main module's.
+	own := pkgs[:0]
+	for _, pkg := range pkgs {
+		if modules && (pkg.Module == nil || !pkg.Module.Main) ||
+			!modules && (pkg.Standard || strings.Contains(pkg.ImportPath, "/vendor/")) {
+			continue
+		}
+		own = append(own, pkg)
+	}
+	return own, nil
+}
+
+// files returns the files which the package is built from, including
+// its module's go.mod and go.sum.
+func (pkg *goPackage) files() []string {
+	var files []string
+	if pkg.Module != nil && pkg.Module.GoMod != "" {
+		files = append(files, pkg.Module.GoMod)
+		sum := filepath.Join(filepath.Dir(pkg.Module.GoMod), "go.sum")
+		if _, err := os.Stat(sum); err == nil {
+			files = append(files, sum)
+		}
+	}
+	for _, names := range [][]string{
+		pkg.GoFiles, pkg.CgoFiles, pkg.CFiles, pkg.CXXFiles,
+		pkg.HFiles, pkg.SFiles, pkg.SysoFiles, pkg.EmbedFiles,
+	} {
+		for _, name := range names {
+			files = append(files, filepath.Join(pkg.Dir, name))
+		}
+	}
+	return files
+}
+
+// Update lists the files again, watching any new ones, and no longer
+// watching those which are gone if the Watcher supports removing them.
+func (g *GoPackages) Update() error {
+	files, err := g.Files()
+	if err != nil {
+		return err
+	}
+	return g.watch(files)
+}
+
+// watch watches the directories of the given files, and no longer
+// watches any others which were, if the Watcher supports removing them.
+func (g *GoPackages) watch(files []string) error {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.files = make(map[string]bool, len(files))
+	dirs := make(map[string]bool)
+	for _, path := range files {
+		g.files[path] = true
+		dir := filepath.Dir(path)
+		if dirs[dir] {
+			continue
+		}
+		dirs[dir] = true
+		if g.watched[dir] {
+			continue
+		}
+		if err := g.w.Add(dir); err != nil {
+			return err
+		}
+		g.watched[dir] = true
+	}
+	if r, ok := g.w.(remover); ok {
+		for dir := range g.watched {
+			if dirs[dir] {
+				continue
+			}
+			// A directory which was deleted may have stopped being
+			// watched already.
+			if err := r.Remove(dir); err != nil {
+				if _, statErr := os.Stat(dir); statErr == nil {
+					return err
+				}
+			}
+			delete(g.watched, dir)
+		}
+	}
+	g.log.Debug("watching Go packages", Fields{"files": len(g.files), "directories": len(g.watched)})
+	return nil
+}
+
+// match returns whether the path is one of the files, or else under
+// one of the watched directories.
+func (g *GoPackages) match(path string) (owned, built bool) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.files[path] {
+		return true, true
+	}
+	for dir := range g.watched {
+		if path == dir || strings.HasPrefix(path, strings.TrimSuffix(dir, string(filepath.Separator))+string(filepath.Separator)) {
+			return true, false
+		}
+	}
+	return false, false
+}
+
+// forget stops watching the path if it is a watched directory, which
+// changes only if it is removed or renamed, so that it is watched again
+// by the next update if it is back.
+func (g *GoPackages) forget(path string) bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if !g.watched[path] {
+		return false
+	}
+	if r, ok := g.w.(remover); ok {
+		_ = r.Remove(path)
+	}
+	delete(g.watched, path)
+	return true
+}
+
+// change returns whether a change to the path affects the binary,
+// listing the files again first if it may have changed them. Paths
+// which are not under the watched directories are left to the caller.
+func (g *GoPackages) change(path string) bool {
+	owned, built := g.match(path)
+	if !owned {
+		return true
+	}
+	if g.forget(path) || goSource(path) {
+		if err := g.Update(); err != nil {
+			g.log.Warn("failed to update Go packages", Fields{"error": err.Error()})
+		}
+		_, now := g.match(path)
+		built = built || now
+	}
+	if !built {
+		g.log.Debug("ignoring change outside Go packages", Fields{"path": path})
+	}
+	return built
+}
+
+// goSource returns whether a change to the path may change the
+// packages which are imported.
+func goSource(path string) bool {
+	return filepath.Ext(path) == ".go" || filepath.Base(path) == "go.mod"
+}
+
+// remover is implemented by watchers which can stop watching a path.
+type remover interface {
+	Remove(path string) error
+}
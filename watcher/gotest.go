@@ -0,0 +1,119 @@
+package watcher
+
+import (
+	"bufio"
+	"bytes"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Tests are run with go test for the packages of the changed Go files
+// before the command is restarted. If they fail, the running generation
+// is kept, and the packages are tested again along with those of the
+// next change.
+type Tests struct {
+	// Run, if set, is passed to go test's -run to select the tests.
+	Run string
+
+	// Short passes -short to go test.
+	Short bool
+}
+
+// args returns the arguments to go test for the given packages.
+func (t *Tests) args(pkgs []string) []string {
+	args := []string{"test"}
+	if t.Run != "" {
+		args = append(args, "-run", t.Run)
+	}
+	if t.Short {
+		args = append(args, "-short")
+	}
+	return append(args, pkgs...)
+}
+
+// testPackages returns the directories of the changed Go files which
+// still exist, as patterns for go test.
+func testPackages(paths []string) []string {
+	var pkgs []string
+	for _, path := range paths {
+		if filepath.Ext(path) != ".go" {
+			continue
+		}
+		dir := filepath.Dir(path)
+		if fi, err := os.Stat(dir); err != nil || !fi.IsDir() {
+			continue
+		}
+		if !filepath.IsAbs(dir) {
+			dir = "." + string(filepath.Separator) + dir
+		}
+		if !contains(pkgs, dir) {
+			pkgs = append(pkgs, dir)
+		}
+	}
+	sort.Strings(pkgs)
+	return pkgs
+}
+
+// test runs the tests for the packages of the changed paths, and those
+// which last failed, copying their output as the build's is. It returns
+// whether they passed, or true if there are none.
+func (s *Supervisor) test() bool {
+	if s.Tests == nil {
+		return true
+	}
+	paths := s.changed
+	for _, path := range s.untested {
+		if !contains(paths, path) {
+			paths = append(paths, path)
+		}
+	}
+	pkgs := testPackages(paths)
+	if len(pkgs) == 0 {
+		s.untested = nil
+		return true
+	}
+
+	started := time.Now()
+	var buf bytes.Buffer
+	stdout, stderr, flush := s.toolWriters(&buf)
+	cmd := exec.Command("go", s.Tests.args(pkgs)...)
+	cmd.Stdout, cmd.Stderr = stdout, stderr
+	err := cmd.Run()
+	flush()
+
+	passed, failed := testSummary(buf.Bytes())
+	e := Event{Err: err, Duration: time.Since(started), Output: buf.Bytes()}
+	if err != nil {
+		s.untested = paths
+		e.Type, e.Packages = EventTestsFailed, failed
+		s.emit(LevelError, "tests failed; waiting for changes...", e)
+		return false
+	}
+	s.untested = nil
+	e.Type, e.Packages = EventTested, passed
+	s.emit(LevelInfo, "tests passed", e)
+	return true
+}
+
+// testSummary returns the packages which passed and failed in the
+// output of go test.
+func testSummary(output []byte) (passed, failed []string) {
+	scanner := bufio.NewScanner(bytes.NewReader(output))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 2 {
+			continue
+		}
+		switch fields[0] {
+		case "ok":
+			passed = append(passed, fields[1])
+		case "FAIL":
+			failed = append(failed, fields[1])
+		}
+	}
+	return passed, failed
+}
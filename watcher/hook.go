@@ -0,0 +1,153 @@
+package watcher
+
+import (
+	"context"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Hook names.
+const (
+	HookPreStart  = "pre-start"
+	HookPostStart = "post-start"
+	HookPreStop   = "pre-stop"
+	HookPostStop  = "post-stop"
+)
+
+// Policies for a failed start hook.
+const (
+	// HookIgnore logs the failure and carries on.
+	HookIgnore = "ignore"
+	// HookAbort leaves the command stopped until the next change, as
+	// for a failed build.
+	HookAbort = "abort"
+	// HookExit stops the command and exits.
+	HookExit = "exit"
+)
+
+// Reasons for stopping a generation, besides those for starting the
+// next one.
+const (
+	reasonStop        = "stop"
+	reasonShutdown    = "shutdown"
+	reasonExit        = "exit"
+	reasonHookFailure = "hook_failure"
+)
+
+// Hooks are commands run around every generation of the command, for
+// example to apply migrations before it starts. Their output goes to
+// stdout and stderr, and they are run with the environment variables:
+//
+//	AUTORELOADER_HOOK           the name of the hook, such as "pre-start"
+//	AUTORELOADER_GENERATION     the generation being started or stopped
+//	AUTORELOADER_REASON         why it is being started or stopped, such as "file_change"
+//	AUTORELOADER_CHANGED_PATHS  the changed paths, separated by os.PathListSeparator
+//	AUTORELOADER_PID            the command's pid, while it is running
+//	AUTORELOADER_EXIT_CODE      the command's exit code, or 128 plus the
+//	                            signal which killed it, for post-stop
+type Hooks struct {
+	// PreStart is run before every generation is started.
+	PreStart []string
+	// PostStart is run once every generation is ready.
+	PostStart []string
+	// PreStop is run before every generation is stopped by the
+	// supervisor.
+	PreStop []string
+	// PostStop is run once every generation has exited.
+	PostStop []string
+
+	// Timeout, if set, is how long a hook may run before it is killed
+	// and treated as failed.
+	Timeout time.Duration
+
+	// OnFailure is the policy for a failed start hook: HookIgnore,
+	// HookAbort or HookExit. Failed stop hooks are only logged, as the
+	// command is stopped either way.
+	OnFailure string
+}
+
+// hookEnv describes the generation a hook is run for.
+type hookEnv struct {
+	generation int
+	reason     string
+	paths      []string
+	pid        int
+	exitCode   int
+	exited     bool
+}
+
+// command returns the command for the named hook.
+func (h *Hooks) command(name string) []string {
+	switch name {
+	case HookPreStart:
+		return h.PreStart
+	case HookPostStart:
+		return h.PostStart
+	case HookPreStop:
+		return h.PreStop
+	default:
+		return h.PostStop
+	}
+}
+
+// run runs the named hook, returning an error if it fails or times out.
+func (h *Hooks) run(name string, args []string, env hookEnv) error {
+	ctx := context.Background()
+	if h.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, h.Timeout)
+		defer cancel()
+	}
+
+	cmd := exec.CommandContext(ctx, args[0], args[1:]...)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.Env = append(os.Environ(),
+		"AUTORELOADER_HOOK="+name,
+		"AUTORELOADER_GENERATION="+strconv.Itoa(env.generation),
+		"AUTORELOADER_REASON="+env.reason,
+		"AUTORELOADER_CHANGED_PATHS="+strings.Join(env.paths, string(os.PathListSeparator)),
+	)
+	if env.pid != 0 {
+		cmd.Env = append(cmd.Env, "AUTORELOADER_PID="+strconv.Itoa(env.pid))
+	}
+	if env.exited {
+		cmd.Env = append(cmd.Env, "AUTORELOADER_EXIT_CODE="+strconv.Itoa(env.exitCode))
+	}
+
+	err := cmd.Run()
+	if ctx.Err() == context.DeadlineExceeded {
+		return errors.Errorf("%s hook timed out after %s", name, h.Timeout)
+	}
+	return errors.Wrapf(err, "%s hook failed", name)
+}
+
+// hook runs the named hook, if set, emitting EventHookFailed if it
+// fails. Failures are logged as errors unless they are ignored.
+func (s *Supervisor) hook(name string, env hookEnv) error {
+	if s.Hooks == nil {
+		return nil
+	}
+	args := s.Hooks.command(name)
+	if len(args) == 0 {
+		return nil
+	}
+
+	started := time.Now()
+	err := s.Hooks.run(name, args, env)
+	e := Event{Type: EventHookFailed, PID: env.pid, Hook: name, Err: err, Duration: time.Since(started)}
+	switch {
+	case err == nil:
+		s.Log.Debug("hook finished", Fields{"hook": name, "duration": e.Duration})
+	case name == HookPreStop || name == HookPostStop || s.Hooks.OnFailure == HookIgnore:
+		s.emit(LevelWarn, "hook failed", e)
+	default:
+		s.emit(LevelError, "hook failed", e)
+	}
+	return err
+}
@@ -0,0 +1,129 @@
+package watcher
+
+import (
+	"bufio"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+
+	"github.com/pkg/errors"
+)
+
+// keysHelp lists the keys read by Interactive.
+const keysHelp = "keys: r restart, b rebuild, p pause/resume watching, c clear, q quit, h help"
+
+// Interactive reads single keys from the given terminal as commands:
+//
+//	r  restart the command
+//	b  build and restart the command
+//	p  pause or resume watching
+//	c  clear the screen
+//	q  stop the command and quit, by calling quit
+//	h  list the keys
+//
+// Keys are only commands at the start of a line. Any other input is
+// echoed, and passed through to the command a line at a time, with
+// Ctrl-D closing its stdin. The returned function restores the
+// terminal, which is also done before the supervisor exits.
+func (s *Supervisor) Interactive(tty *os.File, quit func()) (restore func(), err error) {
+	restoreTerm, err := makeCbreak(int(tty.Fd()))
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read keys")
+	}
+	var once sync.Once
+	restore = func() {
+		once.Do(func() { _ = restoreTerm() })
+	}
+
+	s.mu.Lock()
+	s.interactive, s.restoreTerm = true, restore
+	s.mu.Unlock()
+
+	// Restore the terminal rather than leave it without echo.
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-sigs
+		restore()
+		quit()
+	}()
+
+	go s.readKeys(bufio.NewReader(tty), quit)
+	s.Log.Info(keysHelp, nil)
+	return restore, nil
+}
+
+// readKeys reads keys and input from the terminal until it is closed.
+func (s *Supervisor) readKeys(r *bufio.Reader, quit func()) {
+	var line []byte
+	for {
+		b, err := r.ReadByte()
+		if err != nil {
+			return
+		}
+
+		if len(line) == 0 {
+			switch b {
+			case 'r':
+				go func() { s.report("restart", s.RestartCommand()) }()
+				continue
+			case 'b':
+				go func() { s.report("rebuild", s.Rebuild()) }()
+				continue
+			case 'p':
+				s.mu.Lock()
+				paused := s.paused
+				s.mu.Unlock()
+				if paused {
+					s.Resume()
+				} else {
+					s.Pause()
+				}
+				continue
+			case 'c':
+				_, _ = os.Stdout.WriteString("\x1b[H\x1b[2J")
+				continue
+			case 'q':
+				quit()
+				return
+			case 'h':
+				s.Log.Info(keysHelp, nil)
+				continue
+			case 4: // Ctrl-D
+				s.mu.Lock()
+				if s.stdin != nil {
+					_ = s.stdin.Close()
+				}
+				s.mu.Unlock()
+				continue
+			}
+		}
+
+		switch b {
+		case '\n', '\r':
+			_, _ = os.Stdout.WriteString("\n")
+			s.mu.Lock()
+			if s.stdin != nil {
+				_, _ = s.stdin.Write(append(line, '\n'))
+			}
+			s.mu.Unlock()
+			line = nil
+		case 127, '\b':
+			if len(line) > 0 {
+				line = line[:len(line)-1]
+				_, _ = os.Stdout.WriteString("\b \b")
+			}
+		default:
+			line = append(line, b)
+			_, _ = os.Stdout.Write([]byte{b})
+		}
+	}
+}
+
+// report logs the error from the operation triggered by a key, if any.
+func (s *Supervisor) report(op string, err error) {
+	if err != nil {
+		s.Log.Error(op+" failed", Fields{"error": err.Error()})
+	}
+}
@@ -0,0 +1,69 @@
+package watcher
+
+import (
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+	"syscall"
+
+	"github.com/pkg/errors"
+)
+
+// listenShimEnv marks a child which should set LISTEN_PID to its own pid
+// before exec'ing the command, as the pid is not known until the child
+// has been started.
+const listenShimEnv = "AUTORELOADER_LISTEN_SHIM"
+
+// Listen opens a TCP listener on the given address, which is then passed
+// to every generation of the command.
+func (s *Supervisor) Listen(addr string) error {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return errors.Wrapf(err, "failed to listen on %s", addr)
+	}
+	defer l.Close()
+
+	// The file is a duplicate, so the socket stays open once the
+	// listener is closed.
+	f, err := l.(*net.TCPListener).File()
+	if err != nil {
+		return errors.Wrapf(err, "failed to listen on %s", addr)
+	}
+	s.Listeners = append(s.Listeners, f)
+	return nil
+}
+
+// activate configures cmd to inherit the listeners from fd 3 onwards,
+// running it through ExecListenShim so that LISTEN_PID can be set.
+func (s *Supervisor) activate(cmd *exec.Cmd) error {
+	self, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	cmd.Path = self
+	cmd.Args = append([]string{self, s.Cmd}, s.Args...)
+	cmd.Env = append(os.Environ(),
+		listenShimEnv+"=1",
+		"LISTEN_FDS="+strconv.Itoa(len(s.Listeners)),
+	)
+	cmd.ExtraFiles = s.Listeners
+	return nil
+}
+
+// ExecListenShim replaces the current process with the command given in
+// its arguments if it was started by a Supervisor with Listeners, after
+// setting LISTEN_PID. Otherwise it returns immediately. Programs running
+// a Supervisor with Listeners must call it at the start of main, as the
+// command is started by re-executing them.
+func ExecListenShim() {
+	if os.Getenv(listenShimEnv) == "" {
+		return
+	}
+	must(os.Unsetenv(listenShimEnv), "")
+	must(os.Setenv("LISTEN_PID", strconv.Itoa(os.Getpid())), "")
+
+	path, err := exec.LookPath(os.Args[1])
+	must(err, "")
+	must(syscall.Exec(path, os.Args[1:], os.Environ()), "exec")
+}
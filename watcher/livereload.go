@@ -0,0 +1,142 @@
+package watcher
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// LiveReloadPath is the path at which a LiveReload is served by a Proxy.
+// The script which reloads the page is served at the same path with a
+// ".js" suffix.
+const LiveReloadPath = "/__livereload"
+
+// LiveReload serves a stream of Server-Sent Events telling browsers to
+// reload whenever the command is ready after a restart, along with a
+// script which does so.
+type LiveReload struct {
+	mu      sync.Mutex
+	clients map[chan int]struct{}
+}
+
+// NewLiveReload returns a LiveReload which follows the state of the
+// command from the given events.
+func NewLiveReload(events <-chan Event) *LiveReload {
+	l := &LiveReload{clients: make(map[chan int]struct{})}
+	go l.follow(events)
+	return l
+}
+
+// follow notifies every client when the command is first ready after
+// being started.
+func (l *LiveReload) follow(events <-chan Event) {
+	var started bool
+	for e := range events {
+		switch e.Type {
+		case EventStarted:
+			started = true
+			continue
+		case EventReady:
+			if !started {
+				continue
+			}
+			started = false
+		default:
+			continue
+		}
+
+		l.mu.Lock()
+		for c := range l.clients {
+			select {
+			case c <- e.PID:
+			default:
+			}
+		}
+		l.mu.Unlock()
+	}
+}
+
+// ServeHTTP serves the script for paths ending in ".js", and the event
+// stream otherwise.
+func (l *LiveReload) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	if strings.HasSuffix(r.URL.Path, ".js") {
+		w.Header().Set("Content-Type", "application/javascript")
+		fmt.Fprint(w, liveReloadScript)
+		return
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	flusher.Flush()
+
+	c := make(chan int, 1)
+	l.mu.Lock()
+	l.clients[c] = struct{}{}
+	l.mu.Unlock()
+	defer func() {
+		l.mu.Lock()
+		delete(l.clients, c)
+		l.mu.Unlock()
+	}()
+
+	ping := time.NewTicker(30 * time.Second)
+	defer ping.Stop()
+	for {
+		select {
+		case pid := <-c:
+			fmt.Fprintf(w, "event: reload\ndata: %d\n\n", pid)
+		case <-ping.C:
+			fmt.Fprint(w, ": ping\n\n")
+		case <-r.Context().Done():
+			return
+		}
+		flusher.Flush()
+	}
+}
+
+// liveReloadScript reloads the page whenever the event stream, served
+// alongside it, says so.
+const liveReloadScript = `(function() {
+  var src = document.currentScript.src.replace(/\.js$/, "");
+  new EventSource(src).addEventListener("reload", function() {
+    location.reload();
+  });
+})();
+`
+
+// injectLiveReload adds a script tag loading the LiveReload script to
+// HTML responses.
+func injectLiveReload(resp *http.Response) error {
+	if !strings.HasPrefix(resp.Header.Get("Content-Type"), "text/html") ||
+		resp.Header.Get("Content-Encoding") != "" {
+		return nil
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return err
+	}
+
+	tag := []byte(`<script src="` + LiveReloadPath + `.js"></script>`)
+	if i := bytes.LastIndex(bytes.ToLower(body), []byte("</body>")); i >= 0 {
+		body = append(body[:i], append(tag, body[i:]...)...)
+	} else {
+		body = append(body, tag...)
+	}
+
+	resp.Body = ioutil.NopCloser(bytes.NewReader(body))
+	resp.ContentLength = int64(len(body))
+	resp.Header.Set("Content-Length", strconv.Itoa(len(body)))
+	return nil
+}
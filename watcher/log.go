@@ -0,0 +1,138 @@
+package watcher
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Level is the severity of a log message.
+type Level int
+
+// Levels.
+const (
+	LevelDebug Level = iota
+	LevelInfo
+	LevelWarn
+	LevelError
+)
+
+var levels = map[Level]string{
+	LevelDebug: "debug",
+	LevelInfo:  "info",
+	LevelWarn:  "warn",
+	LevelError: "error",
+}
+
+// String returns the name of the level.
+func (l Level) String() string {
+	return levels[l]
+}
+
+// ParseLevel returns the level with the given name.
+func ParseLevel(name string) (Level, error) {
+	for l, s := range levels {
+		if s == name {
+			return l, nil
+		}
+	}
+	return 0, errors.Errorf("unknown log level %q", name)
+}
+
+// Fields are the structured values attached to a log message.
+type Fields map[string]interface{}
+
+// Logger writes levelled log messages, either as text or as one JSON
+// object per line. Durations are written in seconds in JSON.
+type Logger struct {
+	Out   io.Writer
+	JSON  bool
+	Level Level
+
+	mu sync.Mutex
+}
+
+// NewLogger returns a Logger writing to out in the given format, which
+// is either "text" or "json".
+func NewLogger(out io.Writer, format string) (*Logger, error) {
+	switch format {
+	case "text":
+		return &Logger{Out: out, Level: LevelInfo}, nil
+	case "json":
+		return &Logger{Out: out, JSON: true, Level: LevelInfo}, nil
+	}
+	return nil, errors.Errorf("unknown log format %q", format)
+}
+
+// Log writes the message, if it is at least as severe as l.Level.
+func (l *Logger) Log(level Level, msg string, fields Fields) {
+	if level < l.Level {
+		return
+	}
+
+	var buf bytes.Buffer
+	if l.JSON {
+		m := map[string]interface{}{
+			"time":  time.Now().Format(time.RFC3339Nano),
+			"level": level.String(),
+			"msg":   msg,
+		}
+		for k, v := range fields {
+			if d, ok := v.(time.Duration); ok {
+				v = d.Seconds()
+			}
+			m[k] = v
+		}
+		_ = json.NewEncoder(&buf).Encode(m)
+	} else {
+		buf.WriteString(msg)
+		keys := make([]string, 0, len(fields))
+		for k := range fields {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			v := fmt.Sprint(fields[k])
+			if strings.ContainsAny(v, " \t\"=") {
+				v = fmt.Sprintf("%q", v)
+			}
+			fmt.Fprintf(&buf, " %s=%s", k, v)
+		}
+		buf.WriteByte('\n')
+	}
+	l.write(buf.Bytes())
+}
+
+// write writes p to Out, without interleaving it with other messages.
+func (l *Logger) write(p []byte) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	_, _ = l.Out.Write(p)
+}
+
+// Debug logs a debug message.
+func (l *Logger) Debug(msg string, fields Fields) {
+	l.Log(LevelDebug, msg, fields)
+}
+
+// Info logs an informational message.
+func (l *Logger) Info(msg string, fields Fields) {
+	l.Log(LevelInfo, msg, fields)
+}
+
+// Warn logs a warning.
+func (l *Logger) Warn(msg string, fields Fields) {
+	l.Log(LevelWarn, msg, fields)
+}
+
+// Error logs an error.
+func (l *Logger) Error(msg string, fields Fields) {
+	l.Log(LevelError, msg, fields)
+}
@@ -0,0 +1,231 @@
+package watcher
+
+import (
+	"compress/gzip"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// LogFile is a file which the command's output is copied to, rotated by
+// size or at midnight. Rotated files are gzipped, and the oldest are
+// removed.
+type LogFile struct {
+	Path string
+
+	// MaxSize is the size in bytes after which the file is rotated, or
+	// zero to not rotate by size.
+	MaxSize int64
+
+	// Daily rotates the file at midnight.
+	Daily bool
+
+	// MaxBackups is the number of rotated files to keep, or zero to
+	// keep them all.
+	MaxBackups int
+
+	// PerGeneration starts a new file for each generation of the
+	// command, with the generation number before the extension. The
+	// files of all but the last MaxBackups previous generations are
+	// removed.
+	PerGeneration bool
+
+	// Log, if set, receives errors writing or compressing the file,
+	// which otherwise go to stderr.
+	Log *Logger
+
+	mu         sync.Mutex
+	f          *os.File
+	size       int64
+	day        string
+	generation int
+	failed     bool // whether an error has already been logged
+}
+
+// Write writes p to the file, rotating it first if needed. Errors are
+// logged once and otherwise ignored, so that the command is never held
+// up by its log file.
+func (l *LogFile) Write(p []byte) (int, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if err := l.write(p); err != nil && !l.failed {
+		l.failed = true
+		l.logger().Error("failed to write log file", Fields{"path": l.name(), "error": err.Error()})
+	}
+	return len(p), nil
+}
+
+func (l *LogFile) write(p []byte) error {
+	day := time.Now().Format("2006-01-02")
+	switch {
+	case l.f == nil:
+		if err := l.open(); err != nil {
+			return err
+		}
+	case l.MaxSize > 0 && l.size+int64(len(p)) > l.MaxSize,
+		l.Daily && day != l.day:
+		if err := l.rotate(); err != nil {
+			return err
+		}
+	}
+	n, err := l.f.Write(p)
+	l.size += int64(n)
+	return err
+}
+
+// Close closes the file.
+func (l *LogFile) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.close()
+}
+
+func (l *LogFile) close() error {
+	if l.f == nil {
+		return nil
+	}
+	err := l.f.Close()
+	l.f = nil
+	return err
+}
+
+// setGeneration switches to the file for the given generation, if the
+// log file is per generation.
+func (l *LogFile) setGeneration(generation int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if !l.PerGeneration {
+		return
+	}
+	_ = l.close()
+	l.generation = generation
+	l.prune()
+}
+
+// prune removes the files of the generations before the last
+// MaxBackups, along with their rotated backups.
+func (l *LogFile) prune() {
+	if l.MaxBackups <= 0 {
+		return
+	}
+	ext := filepath.Ext(l.Path)
+	base := strings.TrimSuffix(l.Path, ext)
+	names, err := filepath.Glob(base + ".*" + ext)
+	if err != nil {
+		return
+	}
+	for _, name := range names {
+		generation, err := strconv.Atoi(strings.TrimSuffix(strings.TrimPrefix(name, base+"."), ext))
+		if err != nil || generation >= l.generation-l.MaxBackups {
+			continue
+		}
+		_ = os.Remove(name)
+		backups, _ := filepath.Glob(name + ".*.gz")
+		for _, backup := range backups {
+			_ = os.Remove(backup)
+		}
+	}
+}
+
+// logger returns the logger for errors.
+func (l *LogFile) logger() *Logger {
+	if l.Log != nil {
+		return l.Log
+	}
+	return &Logger{Out: os.Stderr, Level: LevelInfo}
+}
+
+// name returns the name of the current file.
+func (l *LogFile) name() string {
+	if !l.PerGeneration {
+		return l.Path
+	}
+	ext := filepath.Ext(l.Path)
+	return strings.TrimSuffix(l.Path, ext) + "." + strconv.Itoa(l.generation) + ext
+}
+
+// open opens the current file for appending.
+func (l *LogFile) open() error {
+	f, err := os.OpenFile(l.name(), os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	l.f, l.size, l.day = f, info.Size(), time.Now().Format("2006-01-02")
+	return nil
+}
+
+// rotate moves the current file aside to be compressed, and opens a new
+// one.
+func (l *LogFile) rotate() error {
+	if err := l.close(); err != nil {
+		return err
+	}
+	name := l.name()
+	backup := name + "." + time.Now().Format("20060102-150405.000")
+	if err := os.Rename(name, backup); err != nil {
+		return err
+	}
+	go l.compress(name, backup)
+	return l.open()
+}
+
+// compress gzips the backup, then removes the oldest backups of the
+// given file.
+func (l *LogFile) compress(name, backup string) {
+	if err := gzipFile(backup); err != nil {
+		l.logger().Error("failed to compress log file", Fields{"path": backup, "error": err.Error()})
+		return
+	}
+	if l.MaxBackups <= 0 {
+		return
+	}
+
+	// The timestamps sort in order, oldest first.
+	backups, err := filepath.Glob(name + ".*.gz")
+	if err != nil {
+		return
+	}
+	sort.Strings(backups)
+	for len(backups) > l.MaxBackups {
+		_ = os.Remove(backups[0])
+		backups = backups[1:]
+	}
+}
+
+// gzipFile replaces the given file with a gzipped copy.
+func gzipFile(path string) error {
+	in, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.Create(path + ".gz")
+	if err != nil {
+		return err
+	}
+	zw := gzip.NewWriter(out)
+	if _, err := io.Copy(zw, in); err != nil {
+		out.Close()
+		return err
+	}
+	if err := zw.Close(); err != nil {
+		out.Close()
+		return err
+	}
+	if err := out.Close(); err != nil {
+		return err
+	}
+	return os.Remove(path)
+}
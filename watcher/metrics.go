@@ -0,0 +1,140 @@
+package watcher
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// buildDurationBuckets are the upper bounds, in seconds, of the build
+// duration histogram.
+var buildDurationBuckets = []float64{0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60}
+
+// Metrics serves the state of a Supervisor in the Prometheus text
+// format.
+type Metrics struct {
+	s *Supervisor
+
+	mu           sync.Mutex
+	restarts     map[string]int
+	lastExitCode int
+	started      time.Time // when the command started, or zero
+	builds       []int     // cumulative counts per bucket
+	buildCount   int
+	buildSum     float64
+	buildErrors  int
+}
+
+// NewMetrics returns Metrics for the given Supervisor.
+func NewMetrics(s *Supervisor) *Metrics {
+	m := &Metrics{
+		s:        s,
+		restarts: make(map[string]int),
+		builds:   make([]int, len(buildDurationBuckets)),
+	}
+	go m.follow(s.Subscribe())
+	return m
+}
+
+// follow updates the metrics from the given events.
+func (m *Metrics) follow(events <-chan Event) {
+	for e := range events {
+		m.mu.Lock()
+		switch e.Type {
+		case EventStarted:
+			m.started = e.Time
+			if e.Reason != ReasonStart {
+				m.restarts[e.Reason]++
+			}
+		case EventExited:
+			m.started = time.Time{}
+			m.lastExitCode = e.ExitCode
+		case EventChanged, EventUnhealthy, EventStopped:
+			m.started = time.Time{}
+		case EventBuilt, EventBuildFailed:
+			if e.Type == EventBuildFailed {
+				m.buildErrors++
+			}
+			d := e.Duration.Seconds()
+			for i, le := range buildDurationBuckets {
+				if d <= le {
+					m.builds[i]++
+				}
+			}
+			m.buildCount++
+			m.buildSum += d
+		}
+		m.mu.Unlock()
+	}
+}
+
+// ServeHTTP writes the metrics.
+func (m *Metrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+
+	fmt.Fprintln(w, "# HELP autoreloader_restarts_total Restarts of the command by reason.")
+	fmt.Fprintln(w, "# TYPE autoreloader_restarts_total counter")
+	reasons := []string{ReasonChange, ReasonCrash, ReasonSIGBUS, ReasonHealth}
+	for reason := range m.restarts {
+		if !contains(reasons, reason) {
+			reasons = append(reasons, reason)
+		}
+	}
+	sort.Strings(reasons)
+	for _, reason := range reasons {
+		fmt.Fprintf(w, "autoreloader_restarts_total{reason=%q} %d\n", reason, m.restarts[reason])
+	}
+
+	fmt.Fprintln(w, "# HELP autoreloader_last_exit_code Exit code of the last generation of the command to exit.")
+	fmt.Fprintln(w, "# TYPE autoreloader_last_exit_code gauge")
+	fmt.Fprintf(w, "autoreloader_last_exit_code %d\n", m.lastExitCode)
+
+	var uptime float64
+	if !m.started.IsZero() {
+		uptime = time.Since(m.started).Seconds()
+	}
+	fmt.Fprintln(w, "# HELP autoreloader_child_uptime_seconds How long the current generation of the command has been running.")
+	fmt.Fprintln(w, "# TYPE autoreloader_child_uptime_seconds gauge")
+	fmt.Fprintf(w, "autoreloader_child_uptime_seconds %g\n", uptime)
+
+	fmt.Fprintln(w, "# HELP autoreloader_build_duration_seconds Duration of builds.")
+	fmt.Fprintln(w, "# TYPE autoreloader_build_duration_seconds histogram")
+	for i, le := range buildDurationBuckets {
+		fmt.Fprintf(w, "autoreloader_build_duration_seconds_bucket{le=\"%g\"} %d\n", le, m.builds[i])
+	}
+	fmt.Fprintf(w, "autoreloader_build_duration_seconds_bucket{le=\"+Inf\"} %d\n", m.buildCount)
+	fmt.Fprintf(w, "autoreloader_build_duration_seconds_sum %g\n", m.buildSum)
+	fmt.Fprintf(w, "autoreloader_build_duration_seconds_count %d\n", m.buildCount)
+
+	fmt.Fprintln(w, "# HELP autoreloader_build_failures_total Builds which failed.")
+	fmt.Fprintln(w, "# TYPE autoreloader_build_failures_total counter")
+	fmt.Fprintf(w, "autoreloader_build_failures_total %d\n", m.buildErrors)
+
+	fmt.Fprintln(w, "# HELP autoreloader_watch_events_total Changes reported by the watcher.")
+	fmt.Fprintln(w, "# TYPE autoreloader_watch_events_total counter")
+	fmt.Fprintf(w, "autoreloader_watch_events_total %d\n", atomic.LoadInt64(&m.s.watchEvents))
+
+	var watched int
+	if m.s.watched != nil {
+		watched = m.s.watched()
+	}
+	fmt.Fprintln(w, "# HELP autoreloader_watched_files Files and directories whose changes are watched.")
+	fmt.Fprintln(w, "# TYPE autoreloader_watched_files gauge")
+	fmt.Fprintf(w, "autoreloader_watched_files %d\n", watched)
+}
+
+// contains returns whether the slice contains the string.
+func contains(ss []string, s string) bool {
+	for _, v := range ss {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
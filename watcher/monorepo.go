@@ -0,0 +1,304 @@
+package watcher
+
+import (
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// Monorepo supervises a binary for each main package matching its
+// patterns, watching the files which they are built from with a single
+// Watcher. A change to a file rebuilds and restarts only the binaries
+// built from it, Jobs at a time, using an index of the files which each
+// binary depends on. The index is built from go list, and is updated
+// whenever a Go file or go.mod changes. As with GoPackages, the
+// directories of the files are watched, and changes to other files
+// under them are ignored. Changes to any other watched paths restart
+// every binary.
+//
+// Each binary runs with the settings of the Watcher's Supervisor, other
+// than its Build, Listeners, probes and Tail, and its output is
+// prefixed with its name, which is that of its package's directory. Its
+// LogFile and Quickfix file have its name before their extensions. The
+// main packages are only listed once, by NewMonorepo.
+//
+// Deprecated: please use github.com/cosmtrek/air or another tool instead.
+type Monorepo struct {
+	// BinDir is the directory which the binaries are built into.
+	BinDir string
+
+	// Jobs is the number of binaries which are built at once.
+	Jobs int
+
+	w    backend
+	pkgs *GoPackages
+
+	mu    sync.Mutex          // protects the following
+	mains map[string]string   // the import paths of the binaries, by name
+	index map[string][]string // the names of the binaries built from each file
+}
+
+// backend is implemented by the watchers in this package, which embed a
+// Supervisor and report changes on channels.
+type backend interface {
+	Watcher
+	supervisor() *Supervisor
+	source() (<-chan string, <-chan error, <-chan struct{})
+}
+
+// supervisor returns the Supervisor embedded by a backend.
+func (s *Supervisor) supervisor() *Supervisor {
+	return s
+}
+
+// NewMonorepo returns a Monorepo building the main packages matching
+// the given patterns, such as "./cmd/...", into the bin directory and
+// watching their files with w, which must be one of the watchers in
+// this package.
+//
+// Deprecated: please use github.com/cosmtrek/air or another tool instead.
+func NewMonorepo(w Watcher, patterns []string) (*Monorepo, error) {
+	b, ok := w.(backend)
+	if !ok {
+		return nil, errors.Errorf("unsupported watcher %T", w)
+	}
+	m := &Monorepo{
+		BinDir: "bin",
+		Jobs:   runtime.NumCPU(),
+		w:      b,
+		pkgs:   NewGoPackages(w, b.supervisor().Log, patterns),
+	}
+	if err := m.update(); err != nil {
+		return nil, err
+	}
+	if len(m.mains) == 0 {
+		return nil, errors.Errorf("no main packages match %s", strings.Join(patterns, " "))
+	}
+	return m, nil
+}
+
+// update lists the packages again, rebuilding the index and watching
+// the files in it.
+func (m *Monorepo) update() error {
+	pkgs, err := listGoPackages(m.pkgs.Patterns)
+	if err != nil {
+		return err
+	}
+	byPath := make(map[string]*goPackage, len(pkgs))
+	for _, pkg := range pkgs {
+		byPath[pkg.ImportPath] = pkg
+	}
+
+	mains := make(map[string]string)
+	index := make(map[string][]string)
+	for _, pkg := range pkgs {
+		if pkg.DepOnly || pkg.Name != "main" {
+			continue
+		}
+		name := filepath.Base(pkg.Dir)
+		if other, ok := mains[name]; ok {
+			return errors.Errorf("binaries %s and %s are both named %s", other, pkg.ImportPath, name)
+		}
+		mains[name] = pkg.ImportPath
+
+		seen := make(map[string]bool)
+		for _, path := range append([]string{pkg.ImportPath}, pkg.Deps...) {
+			dep, ok := byPath[path]
+			if !ok {
+				continue
+			}
+			for _, file := range dep.files() {
+				if !seen[file] {
+					seen[file] = true
+					index[file] = append(index[file], name)
+				}
+			}
+		}
+	}
+
+	files := make([]string, 0, len(index))
+	for file := range index {
+		files = append(files, file)
+	}
+	m.mu.Lock()
+	if m.mains == nil {
+		m.mains = mains
+	}
+	m.index = index
+	m.mu.Unlock()
+	return m.pkgs.watch(files)
+}
+
+// Add watches the given path, a change to which restarts every binary.
+//
+// Deprecated: please use github.com/cosmtrek/air or another tool instead.
+func (m *Monorepo) Add(path string) error {
+	return m.w.Add(path)
+}
+
+// Watch builds and runs every binary, until the watcher is closed.
+//
+// Deprecated: please use github.com/cosmtrek/air or another tool instead.
+func (m *Monorepo) Watch() {
+	var (
+		changes, errs, closed = m.w.source()
+		parent                = m.w.supervisor()
+		jobs                  = m.Jobs
+		wg                    sync.WaitGroup
+	)
+	if jobs < 1 {
+		jobs = 1
+	}
+	binDir, err := filepath.Abs(m.BinDir)
+	must(err, "failed to find bin directory")
+
+	m.mu.Lock()
+	names := make([]string, 0, len(m.mains))
+	for name := range m.mains {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	builds := make(chan struct{}, jobs)
+	services := make(map[string]chan string, len(names))
+	var logFiles []*LogFile
+	for _, name := range names {
+		s := parent.clone(name)
+		if s.LogFile != nil {
+			logFiles = append(logFiles, s.LogFile)
+		}
+		s.Cmd = filepath.Join(binDir, name)
+		s.Build = []string{"go", "build", "-o", s.Cmd, m.mains[name]}
+		s.builds = builds
+
+		// Changes are buffered so that one binary's build does not
+		// hold up the others'.
+		c := make(chan string, 64)
+		services[name] = c
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			s.supervise(c, nil, closed)
+		}()
+	}
+	m.mu.Unlock()
+
+	for {
+		select {
+		case path := <-changes:
+			m.route(path, services)
+		case err := <-errs:
+			must(err, "error while polling files")
+		case <-closed:
+			wg.Wait()
+			for _, l := range logFiles {
+				if err := l.Close(); err != nil {
+					parent.Log.Warn("failed to close log file", Fields{"path": l.Path, "error": err.Error()})
+				}
+			}
+			return
+		}
+	}
+}
+
+// route forwards the changed path to the binaries built from it before
+// and after updating the index, which it is first if the path may have
+// changed which packages are imported, or to every binary if it is not
+// under the packages' directories.
+func (m *Monorepo) route(path string, services map[string]chan string) {
+	parent := m.w.supervisor()
+	m.mu.Lock()
+	names := append([]string(nil), m.index[path]...)
+	m.mu.Unlock()
+	owned, _ := m.pkgs.match(path)
+	if owned && (m.pkgs.forget(path) || goSource(path)) {
+		if err := m.update(); err != nil {
+			parent.Log.Warn("failed to update Go packages", Fields{"error": err.Error()})
+		}
+		m.mu.Lock()
+		for _, name := range m.index[path] {
+			if !contains(names, name) {
+				names = append(names, name)
+			}
+		}
+		m.mu.Unlock()
+	}
+	if !owned {
+		for name := range services {
+			names = append(names, name)
+		}
+	}
+	if len(names) == 0 {
+		parent.Log.Debug("ignoring change outside Go packages", Fields{"path": path})
+		return
+	}
+	parent.Log.Debug("changed file affects binaries", Fields{"path": path, "binaries": strings.Join(names, ",")})
+	for _, name := range names {
+		// A full buffer already holds a change, which will rebuild
+		// the binary.
+		select {
+		case services[name] <- path:
+		default:
+		}
+	}
+}
+
+// Start starts the underlying watcher.
+//
+// Deprecated: please use github.com/cosmtrek/air or another tool instead.
+func (m *Monorepo) Start() error {
+	return m.w.Start()
+}
+
+// Deprecated: please use github.com/cosmtrek/air or another tool instead.
+func (m *Monorepo) Close() error {
+	return m.w.Close()
+}
+
+// clone returns a Supervisor for the named binary with the settings of
+// s which may be shared between binaries.
+func (s *Supervisor) clone(name string) *Supervisor {
+	c := newSupervisor(s.Autorestart, 0, "", s.Args)
+	c.Interval = s.Interval
+	c.Ops = s.Ops
+	c.Log = s.Log
+	c.Hooks = s.Hooks
+	c.Rules = s.Rules
+	c.Tests = s.Tests
+	c.Dir = s.Dir
+	c.credential = s.credential
+	c.name = name
+	if s.LogFile != nil {
+		c.LogFile = &LogFile{
+			Path:          servicePath(s.LogFile.Path, name),
+			MaxSize:       s.LogFile.MaxSize,
+			Daily:         s.LogFile.Daily,
+			MaxBackups:    s.LogFile.MaxBackups,
+			PerGeneration: s.LogFile.PerGeneration,
+			Log:           s.LogFile.Log,
+		}
+	}
+	if s.Quickfix != "" {
+		c.Quickfix = servicePath(s.Quickfix, name)
+	}
+
+	var output Output
+	if s.Output != nil {
+		output = *s.Output
+	}
+	if output.Prefix == "" {
+		output.Prefix = name
+	}
+	c.Output = &output
+	return &c
+}
+
+// servicePath returns the path with the name of a binary inserted before
+// its extension, such as "app.api.log" for "app.log".
+func servicePath(path, name string) string {
+	ext := filepath.Ext(path)
+	return strings.TrimSuffix(path, ext) + "." + name + ext
+}
@@ -0,0 +1,55 @@
+package watcher
+
+import (
+	"strings"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/pkg/errors"
+)
+
+// Op is a set of filesystem operations.
+type Op uint32
+
+// Operations.
+const (
+	OpCreate Op = 1 << iota
+	OpWrite
+	OpRemove
+	OpRename
+	OpChmod
+)
+
+// DefaultOps are the operations which trigger a reload by default,
+// ignoring changes only to permissions.
+const DefaultOps = OpCreate | OpWrite | OpRemove | OpRename
+
+var opNames = map[string]Op{
+	"create": OpCreate,
+	"write":  OpWrite,
+	"remove": OpRemove,
+	"rename": OpRename,
+	"chmod":  OpChmod,
+}
+
+// ParseOps returns the operations in the given comma-separated list,
+// such as "create,write".
+func ParseOps(list string) (Op, error) {
+	var ops Op
+	for _, name := range strings.Split(list, ",") {
+		op, ok := opNames[strings.TrimSpace(name)]
+		if !ok {
+			return 0, errors.Errorf("unknown operation %q", name)
+		}
+		ops |= op
+	}
+	return ops, nil
+}
+
+// fsnotify returns whether the fsnotify operations include any of ops.
+func (ops Op) fsnotify(op fsnotify.Op) bool {
+	return ops&OpCreate != 0 && op&fsnotify.Create != 0 ||
+		ops&OpWrite != 0 && op&fsnotify.Write != 0 ||
+		ops&OpRemove != 0 && op&fsnotify.Remove != 0 ||
+		ops&OpRename != 0 && op&fsnotify.Rename != 0 ||
+		ops&OpChmod != 0 && op&fsnotify.Chmod != 0
+}
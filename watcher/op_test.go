@@ -0,0 +1,35 @@
+package watcher
+
+import "testing"
+
+func TestParseOps(t *testing.T) {
+	tests := []struct {
+		list string
+		ops  Op
+		err  bool
+	}{
+		{list: "create", ops: OpCreate},
+		{list: "create,write", ops: OpCreate | OpWrite},
+		{list: " remove , rename ", ops: OpRemove | OpRename},
+		{list: "create,write,remove,rename,chmod", ops: DefaultOps | OpChmod},
+		{list: "write,write", ops: OpWrite},
+		{list: "", err: true},
+		{list: "create,", err: true},
+		{list: "Write", err: true},
+		{list: "delete", err: true},
+	}
+	for _, test := range tests {
+		ops, err := ParseOps(test.list)
+		if test.err {
+			if err == nil {
+				t.Errorf("ParseOps(%q) = %v, want an error", test.list, ops)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("ParseOps(%q) failed: %v", test.list, err)
+		} else if ops != test.ops {
+			t.Errorf("ParseOps(%q) = %v, want %v", test.list, ops, test.ops)
+		}
+	}
+}
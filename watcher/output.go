@@ -0,0 +1,162 @@
+package watcher
+
+import (
+	"bytes"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"sync"
+	"time"
+)
+
+// Output formats the command's output line by line, which is otherwise
+// passed straight through to stdout and stderr.
+type Output struct {
+	// Prefix is written at the start of every line.
+	Prefix string
+
+	// Timestamps is "rfc3339" to write the time at the start of every
+	// line, or "relative" to write the time since the command started.
+	Timestamps string
+
+	// Color colours the prefix and highlights stderr.
+	Color bool
+}
+
+const (
+	// maxLineLength is the length after which a line is written
+	// without waiting for the rest of it.
+	maxLineLength = 64 * 1024
+
+	// partialLineDelay is how long the start of a line is held while
+	// waiting for the rest of it.
+	partialLineDelay = 100 * time.Millisecond
+)
+
+// prefixColors are the ANSI colours for prefixes, leaving red for
+// stderr.
+var prefixColors = []int{32, 33, 34, 35, 36, 92, 93, 94, 95, 96}
+
+// writers returns writers formatting the output of a command started at
+// the given time.
+func (o *Output) writers(stdout, stderr io.Writer, started time.Time) (*lineWriter, *lineWriter) {
+	return &lineWriter{out: stdout, o: o, started: started},
+		&lineWriter{out: stderr, o: o, started: started, stderr: true}
+}
+
+// header returns the start of a line written at the given time.
+func (o *Output) header(started time.Time) []byte {
+	var buf bytes.Buffer
+	if o.Prefix != "" {
+		if o.Color {
+			h := fnv.New32a()
+			_, _ = h.Write([]byte(o.Prefix))
+			color := prefixColors[h.Sum32()%uint32(len(prefixColors))]
+			fmt.Fprintf(&buf, "\x1b[%dm%s\x1b[0m ", color, o.Prefix)
+		} else {
+			fmt.Fprintf(&buf, "%s ", o.Prefix)
+		}
+	}
+	switch o.Timestamps {
+	case "rfc3339":
+		fmt.Fprintf(&buf, "%s ", time.Now().Format(time.RFC3339))
+	case "relative":
+		fmt.Fprintf(&buf, "%9.3fs ", time.Since(started).Seconds())
+	}
+	return buf.Bytes()
+}
+
+// lineWriter writes each line with a header. Partial lines are written
+// once they have waited for partialLineDelay, so that a prompt is not
+// held back, and long lines are written in chunks.
+type lineWriter struct {
+	out     io.Writer
+	o       *Output
+	started time.Time
+	stderr  bool
+
+	mu      sync.Mutex
+	buf     []byte
+	midLine bool // whether the start of the current line was written
+	timer   *time.Timer
+}
+
+// Write writes every complete line in p, holding back the rest.
+func (w *lineWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.buf = append(w.buf, p...)
+	for {
+		i := bytes.IndexByte(w.buf, '\n')
+		if i < 0 {
+			break
+		}
+		w.write(w.buf[:i+1])
+		w.buf = w.buf[i+1:]
+	}
+	for len(w.buf) >= maxLineLength {
+		w.write(w.buf[:maxLineLength])
+		w.buf = w.buf[maxLineLength:]
+	}
+	w.buf = append([]byte(nil), w.buf...)
+
+	if len(w.buf) > 0 {
+		if w.timer == nil {
+			w.timer = time.AfterFunc(partialLineDelay, w.flushPartial)
+		} else {
+			w.timer.Reset(partialLineDelay)
+		}
+	}
+	return len(p), nil
+}
+
+// flushPartial writes the start of the current line.
+func (w *lineWriter) flushPartial() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if len(w.buf) > 0 {
+		w.write(w.buf)
+		w.buf = nil
+	}
+}
+
+// Close writes anything held back, ending the line.
+func (w *lineWriter) Close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.timer != nil {
+		w.timer.Stop()
+	}
+	if len(w.buf) > 0 {
+		w.write(w.buf)
+		w.buf = nil
+	}
+	if w.midLine {
+		w.write([]byte("\n"))
+	}
+	return nil
+}
+
+// write writes a chunk of a line, with the header if it is the start of
+// the line.
+func (w *lineWriter) write(chunk []byte) {
+	var buf bytes.Buffer
+	if !w.midLine {
+		buf.Write(w.o.header(w.started))
+	}
+	text, newline := chunk, false
+	if n := len(text); n > 0 && text[n-1] == '\n' {
+		text, newline = text[:n-1], true
+	}
+	if w.stderr && w.o.Color {
+		fmt.Fprintf(&buf, "\x1b[31m%s\x1b[0m", text)
+	} else {
+		buf.Write(text)
+	}
+	if newline {
+		buf.WriteByte('\n')
+	}
+	w.midLine = !newline
+	_, _ = w.out.Write(buf.Bytes())
+}
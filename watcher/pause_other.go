@@ -0,0 +1,8 @@
+//go:build !darwin && !dragonfly && !freebsd && !linux && !netbsd && !openbsd
+// +build !darwin,!dragonfly,!freebsd,!linux,!netbsd,!openbsd
+
+package watcher
+
+// PauseOnSignals does nothing, as there are no SIGUSR1 and SIGUSR2 on
+// this platform.
+func (s *Supervisor) PauseOnSignals() {}
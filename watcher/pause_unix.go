@@ -0,0 +1,26 @@
+//go:build darwin || dragonfly || freebsd || linux || netbsd || openbsd
+// +build darwin dragonfly freebsd linux netbsd openbsd
+
+package watcher
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// PauseOnSignals pauses watching on SIGUSR1 and resumes it on SIGUSR2,
+// for example around a long rebase.
+func (s *Supervisor) PauseOnSignals() {
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGUSR1, syscall.SIGUSR2)
+	go func() {
+		for sig := range sigs {
+			if sig == syscall.SIGUSR1 {
+				s.Pause()
+			} else {
+				s.Resume()
+			}
+		}
+	}()
+}
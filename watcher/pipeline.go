@@ -0,0 +1,278 @@
+package watcher
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/json"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// Pipeline is a build of several steps, which is run instead of Build.
+// Each step runs once those it comes after have, and is skipped if the
+// hash of its inputs is unchanged since it last succeeded and its
+// outputs exist. While the command is running, it is only restarted if
+// the pipeline changes its artefacts. The hashes are only kept in
+// memory, so every step runs when the supervisor starts.
+//
+// Patterns are matched as with Rule against the paths of the files
+// under the working directory, skipping hidden directories, vendor and
+// node_modules. A file is only read again to hash it if the poller
+// would see it as changed.
+type Pipeline struct {
+	Steps []*Step `json:"steps"`
+
+	// Artefacts are patterns matching the files whose changes restart
+	// the command. By default they are the outputs of the steps which
+	// no others come after. Without any, the command is restarted
+	// whenever a step runs.
+	Artefacts []string `json:"artefacts"`
+
+	order    []*Step               // the steps, each after those it comes after
+	hashes   map[string][]byte     // the hash of each step's inputs when it last succeeded
+	artefact []byte                // the hash of the artefacts after the last run
+	files    map[string]hashedFile // the hash of each file, with its state when hashed
+}
+
+// hashedFile is the hash of a file's contents.
+type hashedFile struct {
+	st   fileState
+	hash []byte
+}
+
+// A Step is a command in a Pipeline.
+type Step struct {
+	Name string `json:"name"`
+
+	// Command is split on spaces, as Build is.
+	Command string `json:"command"`
+
+	// Inputs are patterns matching the files which the step reads.
+	Inputs []string `json:"inputs"`
+
+	// Outputs are patterns matching the files which the step writes.
+	Outputs []string `json:"outputs"`
+
+	// After names the steps which must run first. If it is absent, the
+	// step comes after the previous one, and if it is empty, it comes
+	// first.
+	After []string `json:"after"`
+}
+
+// LoadPipeline reads a Pipeline from the JSON file at the given path.
+func LoadPipeline(path string) (*Pipeline, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read pipeline")
+	}
+	defer f.Close()
+
+	p := new(Pipeline)
+	if err := json.NewDecoder(f).Decode(p); err != nil {
+		return nil, errors.Wrapf(err, "failed to read pipeline %s", path)
+	}
+	if err := p.sort(); err != nil {
+		return nil, errors.Wrapf(err, "invalid pipeline %s", path)
+	}
+	return p, nil
+}
+
+// sort orders the steps so that each comes after those it depends on,
+// and defaults the artefacts to the outputs of the last steps.
+func (p *Pipeline) sort() error {
+	byName := make(map[string]*Step, len(p.Steps))
+	for i, step := range p.Steps {
+		if step.Name == "" || len(strings.Fields(step.Command)) == 0 {
+			return errors.Errorf("step %d needs a name and a command", i+1)
+		}
+		if byName[step.Name] != nil {
+			return errors.Errorf("duplicate step %s", step.Name)
+		}
+		byName[step.Name] = step
+	}
+
+	deps := make(map[*Step][]*Step)
+	depended := make(map[*Step]bool)
+	for i, step := range p.Steps {
+		after := step.After
+		if after == nil && i > 0 {
+			after = []string{p.Steps[i-1].Name}
+		}
+		for _, name := range after {
+			dep, ok := byName[name]
+			if !ok {
+				return errors.Errorf("step %s comes after unknown step %s", step.Name, name)
+			}
+			deps[step] = append(deps[step], dep)
+			depended[dep] = true
+		}
+	}
+
+	done := make(map[*Step]bool)
+	for len(p.order) < len(p.Steps) {
+		progressed := false
+	next:
+		for _, step := range p.Steps {
+			if done[step] {
+				continue
+			}
+			for _, dep := range deps[step] {
+				if !done[dep] {
+					continue next
+				}
+			}
+			done[step] = true
+			p.order = append(p.order, step)
+			progressed = true
+		}
+		if !progressed {
+			return errors.New("steps come after each other in a cycle")
+		}
+	}
+
+	if p.Artefacts == nil {
+		for _, step := range p.Steps {
+			if !depended[step] {
+				p.Artefacts = append(p.Artefacts, step.Outputs...)
+			}
+		}
+	}
+	p.hashes = make(map[string][]byte)
+	p.files = make(map[string]hashedFile)
+	return nil
+}
+
+// run runs the steps whose inputs have changed, stopping at the first
+// to fail, copying their output to stdout and stderr, and returns
+// whether the artefacts changed.
+func (p *Pipeline) run(log *Logger, stdout, stderr io.Writer) (bool, error) {
+	files, err := listFiles()
+	if err != nil {
+		return false, err
+	}
+	ran := false
+	for _, step := range p.order {
+		if bytes.Equal(p.hash(step, files), p.hashes[step.Name]) && exist(files, step.Outputs) {
+			log.Debug("step unchanged; skipping...", Fields{"step": step.Name})
+			continue
+		}
+
+		log.Info("running step", Fields{"step": step.Name})
+		args := strings.Fields(step.Command)
+		cmd := exec.Command(args[0], args[1:]...)
+		cmd.Stdout, cmd.Stderr = stdout, stderr
+		if err := cmd.Run(); err != nil {
+			delete(p.hashes, step.Name)
+			return false, errors.Wrapf(err, "step %s", step.Name)
+		}
+		ran = true
+
+		// The files are listed again, as the step may have written
+		// its inputs or those of the later steps.
+		if files, err = listFiles(); err != nil {
+			return false, err
+		}
+		p.hashes[step.Name] = p.hash(step, files)
+	}
+
+	for path := range p.files {
+		if _, ok := files[path]; !ok {
+			delete(p.files, path)
+		}
+	}
+	if len(p.Artefacts) == 0 {
+		return ran, nil
+	}
+	hash := p.hashFiles("", files, matchFiles(files, p.Artefacts))
+	changed := !bytes.Equal(hash, p.artefact)
+	p.artefact = hash
+	return changed, nil
+}
+
+// hash returns the hash of the step's command and the contents of its
+// inputs, out of the given files.
+func (p *Pipeline) hash(step *Step, files map[string]fileState) []byte {
+	return p.hashFiles(step.Command, files, matchFiles(files, step.Inputs))
+}
+
+// skipDirs are the directories whose files are not listed, other than
+// hidden ones.
+var skipDirs = map[string]bool{"vendor": true, "node_modules": true}
+
+// listFiles returns the state of each file under the working directory,
+// skipping hidden directories and skipDirs. Files which disappear while
+// they are listed are left out.
+func listFiles() (map[string]fileState, error) {
+	files := make(map[string]fileState)
+	err := filepath.Walk(".", func(path string, fi os.FileInfo, err error) error {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if fi.IsDir() {
+			if path != "." && (strings.HasPrefix(fi.Name(), ".") || skipDirs[fi.Name()]) {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		files[path] = newFileState(fi)
+		return nil
+	})
+	return files, errors.Wrap(err, "failed to list files")
+}
+
+// matchFiles returns the files matching any of the patterns.
+func matchFiles(files map[string]fileState, patterns []string) []string {
+	var matched []string
+	for path := range files {
+		for _, pattern := range patterns {
+			if (&Rule{Pattern: filepath.Clean(pattern)}).Match(path) {
+				matched = append(matched, path)
+				break
+			}
+		}
+	}
+	return matched
+}
+
+// exist returns whether every pattern matches one of the files.
+func exist(files map[string]fileState, patterns []string) bool {
+	for _, pattern := range patterns {
+		if len(matchFiles(files, []string{pattern})) == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// hashFiles returns a hash of the command and the paths and contents of
+// the given paths, out of the files.
+func (p *Pipeline) hashFiles(command string, files map[string]fileState, paths []string) []byte {
+	sort.Strings(paths)
+	h := sha256.New()
+	_, _ = io.WriteString(h, command+"\x00")
+	for _, path := range paths {
+		_, _ = io.WriteString(h, path+"\x00")
+		_, _ = h.Write(p.hashFile(path, files[path]))
+	}
+	return h.Sum(nil)
+}
+
+// hashFile returns the hash of the file's contents, reading it only if
+// it has changed since it was last hashed.
+func (p *Pipeline) hashFile(path string, st fileState) []byte {
+	if f, ok := p.files[path]; ok && !st.changed(f.st) {
+		return f.hash
+	}
+	hash := hashFile(path)
+	p.files[path] = hashedFile{st: st, hash: hash}
+	return hash
+}
@@ -0,0 +1,129 @@
+package watcher
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestPipelineSort(t *testing.T) {
+	tests := []struct {
+		name      string
+		steps     []*Step
+		artefacts []string
+		order     []string
+		want      []string // the artefacts after sorting
+		err       bool
+	}{
+		{
+			name: "each after the previous",
+			steps: []*Step{
+				{Name: "generate", Command: "go generate", Outputs: []string{"*.pb.go"}},
+				{Name: "build", Command: "go build -o app", Outputs: []string{"app"}},
+			},
+			order: []string{"generate", "build"},
+			want:  []string{"app"},
+		},
+		{
+			name: "explicit order",
+			steps: []*Step{
+				{Name: "build", Command: "go build", Outputs: []string{"app"}, After: []string{"css", "js"}},
+				{Name: "js", Command: "npm run js", Outputs: []string{"public/app.js"}, After: []string{}},
+				{Name: "css", Command: "npm run css", Outputs: []string{"public/app.css"}, After: []string{}},
+			},
+			order: []string{"js", "css", "build"},
+			want:  []string{"app"},
+		},
+		{
+			name: "several last steps",
+			steps: []*Step{
+				{Name: "js", Command: "npm run js", Outputs: []string{"public/app.js"}},
+				{Name: "build", Command: "go build", Outputs: []string{"app"}, After: []string{}},
+			},
+			order: []string{"js", "build"},
+			want:  []string{"public/app.js", "app"},
+		},
+		{
+			name: "artefacts given",
+			steps: []*Step{
+				{Name: "build", Command: "go build", Outputs: []string{"app"}},
+			},
+			artefacts: []string{"bin/**"},
+			order:     []string{"build"},
+			want:      []string{"bin/**"},
+		},
+		{
+			name: "empty artefacts kept",
+			steps: []*Step{
+				{Name: "build", Command: "go build", Outputs: []string{"app"}},
+			},
+			artefacts: []string{},
+			order:     []string{"build"},
+			want:      []string{},
+		},
+		{
+			name: "cycle",
+			steps: []*Step{
+				{Name: "a", Command: "true", After: []string{"b"}},
+				{Name: "b", Command: "true", After: []string{"a"}},
+			},
+			err: true,
+		},
+		{
+			name: "after itself",
+			steps: []*Step{
+				{Name: "a", Command: "true", After: []string{"a"}},
+			},
+			err: true,
+		},
+		{
+			name: "unknown step",
+			steps: []*Step{
+				{Name: "build", Command: "go build", After: []string{"generate"}},
+			},
+			err: true,
+		},
+		{
+			name: "duplicate step",
+			steps: []*Step{
+				{Name: "build", Command: "go build"},
+				{Name: "build", Command: "go vet"},
+			},
+			err: true,
+		},
+		{
+			name:  "no name",
+			steps: []*Step{{Command: "go build"}},
+			err:   true,
+		},
+		{
+			name:  "no command",
+			steps: []*Step{{Name: "build", Command: " "}},
+			err:   true,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			p := &Pipeline{Steps: test.steps, Artefacts: test.artefacts}
+			err := p.sort()
+			if test.err {
+				if err == nil {
+					t.Fatal("sort() succeeded, want an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("sort() failed: %v", err)
+			}
+			var order []string
+			for _, step := range p.order {
+				order = append(order, step.Name)
+			}
+			if !reflect.DeepEqual(order, test.order) {
+				t.Errorf("order = %q, want %q", order, test.order)
+			}
+			if !reflect.DeepEqual(p.Artefacts, test.want) {
+				t.Errorf("artefacts = %q, want %q", p.Artefacts, test.want)
+			}
+		})
+	}
+}
@@ -1,115 +1,417 @@
 package watcher
 
 import (
+	"bytes"
+	"crypto/sha256"
+	"io"
 	"os"
-	"os/exec"
-	"syscall"
+	"path/filepath"
+	"sort"
+	"sync"
 	"time"
 
 	"github.com/pkg/errors"
-	"github.com/radovskyb/watcher"
 )
 
 // Deprecated: please use github.com/cosmtrek/air or another tool instead.
 type Poller struct {
-	Autorestart bool
-	Interval    time.Duration
-	Cmd         string
-	Args        []string
-	bin         *exec.Cmd
-	watcher     *watcher.Watcher
+	Supervisor
+
+	// MaxInterval, if longer than Interval, is what the interval
+	// between polls backs off to while nothing changes. It is reset to
+	// Interval after every change.
+	MaxInterval time.Duration
+
+	// Workers is the number of files which are stat'd at once.
+	Workers int
+
+	// Hash, if set, also compares a hash of the contents of every
+	// file, to catch rewrites which leave its size and times unchanged
+	// on filesystems with coarse timestamps. Every file is read on
+	// every poll, so it is best kept to small trees.
+	Hash bool
+
+	mu    sync.Mutex // protects the following
+	roots []string
+	files map[string]fileState // the files as of the last poll
+	held  map[string]Op        // changes held back by a removal
+
+	changes chan string
+	errs    chan error
+	closed  chan struct{}
+	close   sync.Once
 }
 
 // Deprecated: please use github.com/cosmtrek/air or another tool instead.
 func NewPoller(autorestart bool, interval int, cmd string, args []string) *Poller {
-	if interval == 0 {
-		interval = 250
+	p := &Poller{
+		Supervisor: newSupervisor(autorestart, interval, cmd, args),
+		Workers:    8,
+		files:      make(map[string]fileState),
+		changes:    make(chan string),
+		errs:       make(chan error),
+		closed:     make(chan struct{}),
 	}
-	return &Poller{
-		Autorestart: autorestart,
-		Interval:    time.Duration(interval) * time.Millisecond,
-		Cmd:         cmd,
-		Args:        args,
-		watcher:     watcher.New(),
+	p.watched = func() int {
+		p.mu.Lock()
+		defer p.mu.Unlock()
+		return len(p.files)
 	}
+	return p
 }
 
+// Add watches the given file, or directory and its entries.
+//
 // Deprecated: please use github.com/cosmtrek/air or another tool instead.
 func (p *Poller) Add(path string) error {
-	return errors.Wrapf(p.watcher.Add(path), "failed to add path %s", path)
+	// The path is cleaned to match the directories of its entries.
+	path = filepath.Clean(path)
+	if _, err := os.Stat(path); err != nil {
+		return errors.Wrapf(err, "failed to add path %s", path)
+	}
+	added, err := p.scan([]string{path})
+	if err != nil {
+		return errors.Wrapf(err, "failed to add path %s", path)
+	}
+
+	// The files are copied rather than updated in place, as a poll may
+	// be comparing them.
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.roots = append(p.roots, path)
+	files := make(map[string]fileState, len(p.files)+len(added))
+	for file, st := range p.files {
+		files[file] = st
+	}
+	for file, st := range added {
+		if _, ok := files[file]; !ok {
+			files[file] = st
+		}
+	}
+	p.files = files
+	return nil
 }
 
-func (p *Poller) sleep(d time.Duration, events chan watcher.Event) {
-	timer := time.After(d)
-	for {
-		select {
-		case <-events:
-		case <-timer:
-			return
+// Remove stops watching the given path, which must have been added.
+//
+// Deprecated: please use github.com/cosmtrek/air or another tool instead.
+func (p *Poller) Remove(path string) error {
+	path = filepath.Clean(path)
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for i, root := range p.roots {
+		if root != path {
+			continue
+		}
+		p.roots = append(p.roots[:i:i], p.roots[i+1:]...)
+		p.files = p.covered(p.files)
+		delete(p.held, path)
+		return nil
+	}
+	return errors.Errorf("failed to remove path %s: not watched", path)
+}
+
+// covered returns a copy of the files which are still under one of the
+// roots, being a root or one of its entries. p.mu must be held.
+func (p *Poller) covered(files map[string]fileState) map[string]fileState {
+	roots := make(map[string]bool, len(p.roots))
+	for _, root := range p.roots {
+		roots[filepath.Clean(root)] = true
+	}
+	kept := make(map[string]fileState, len(files))
+	for file, st := range files {
+		if roots[file] || roots[filepath.Dir(file)] {
+			kept[file] = st
 		}
 	}
+	return kept
+}
+
+// source returns the channels which changes and errors are forwarded
+// on once started.
+func (p *Poller) source() (<-chan string, <-chan error, <-chan struct{}) {
+	return p.changes, p.errs, p.closed
 }
 
 // Deprecated: please use github.com/cosmtrek/air or another tool instead.
 func (p *Poller) Watch() {
+	p.supervise(p.source())
+}
+
+// Start polls for changes until the poller is closed, backing off from
+// Interval to MaxInterval while nothing changes.
+//
+// Deprecated: please use github.com/cosmtrek/air or another tool instead.
+func (p *Poller) Start() error {
+	interval := p.Interval
+	timer := time.NewTimer(interval)
+	defer timer.Stop()
 	for {
-		p.bin = exec.Command(p.Cmd, p.Args...)
-		p.bin.Stdout = os.Stdout
-		p.bin.Stderr = os.Stderr
-		p.bin.Stdin = os.Stdin
-		must(p.bin.Start(), "bin.Start()")
-
-		// Watch for exit.
-		exited := make(chan error)
-		go func() {
-			exited <- p.bin.Wait()
-		}()
+		select {
+		case <-timer.C:
+		case <-p.closed:
+			return nil
+		}
+
+		if p.poll() {
+			interval = p.Interval
+		} else if interval < p.MaxInterval {
+			interval *= 2
+			if interval > p.MaxInterval {
+				interval = p.MaxInterval
+			}
+		}
+		timer.Reset(interval)
+	}
+}
+
+// Deprecated: please use github.com/cosmtrek/air or another tool instead.
+func (p *Poller) Close() error {
+	p.close.Do(func() { close(p.closed) })
+	return nil
+}
+
+// poll scans the watched files once, forwarding every change which
+// matches Ops, and returns whether anything changed.
+//
+// Changes including a removal are held back for a poll, so that a file
+// which is deleted and then recreated, as some editors and build tools
+// do, is reported as a single change rather than a removal followed by
+// a creation.
+func (p *Poller) poll() bool {
+	p.mu.Lock()
+	roots, prev, held := p.roots, p.files, p.held
+	p.mu.Unlock()
 
+	files, err := p.scan(roots)
+	if err != nil {
 		select {
-		case <-p.watcher.Event:
-			_ = kill(p.bin, "executable changed; reloading...")
-			p.sleep(p.Interval, p.watcher.Event)
-		case err := <-p.watcher.Error:
-			if err != watcher.ErrWatchedFileDeleted {
-				must(err, "error while polling files")
+		case p.errs <- err:
+		case <-p.closed:
+		}
+		return false
+	}
+
+	changed := diff(prev, files)
+	hold := false
+	for _, op := range changed {
+		hold = hold || op == OpRemove
+	}
+	for path, op := range held {
+		if op == OpRemove {
+			if _, ok := files[path]; ok {
+				op = OpCreate | OpWrite
 			}
-		case err := <-exited:
-			var exitCode int
-			if err, ok := err.(*exec.ExitError); ok {
-				if p.Autorestart {
-					_ = kill(p.bin, "executable quit; reloading...")
-					p.sleep(p.Interval, p.watcher.Event)
+			changed[path] = op
+		} else if _, ok := changed[path]; !ok {
+			changed[path] = op
+		}
+	}
+	if hold {
+		held, changed = changed, nil
+	} else {
+		held = nil
+	}
+
+	// Paths added or removed during the scan are kept as they were
+	// left, to be compared from the next poll.
+	p.mu.Lock()
+	for path, st := range p.files {
+		if _, ok := prev[path]; !ok {
+			files[path] = st
+		}
+	}
+	p.files, p.held = p.covered(files), held
+	p.mu.Unlock()
+	paths := make([]string, 0, len(changed))
+	for path := range changed {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	for _, path := range paths {
+		if p.Ops&changed[path] == 0 {
+			continue
+		}
+		select {
+		case p.changes <- path:
+		case <-p.closed:
+			return false
+		}
+	}
+	return len(changed) > 0 || len(held) > 0
+}
+
+// fileState is what is compared to find changes to a file.
+type fileState struct {
+	size     int64
+	mode     os.FileMode
+	mtime    time.Time
+	ctime    time.Time
+	dev, ino uint64 // zero where unsupported
+	hash     []byte // set if Hash is
+}
+
+// newFileState returns the state of the file with the given info.
+func newFileState(fi os.FileInfo) fileState {
+	st := fileState{size: fi.Size(), mode: fi.Mode(), mtime: fi.ModTime()}
+	st.dev, st.ino, st.ctime = statSys(fi)
+	return st
+}
+
+// replaced returns whether the file was replaced by another, having
+// been renamed over or deleted and recreated.
+func (st fileState) replaced(old fileState) bool {
+	return st.ino != 0 && (st.ino != old.ino || st.dev != old.dev)
+}
+
+// written returns whether the file's contents changed, going by its
+// size, modification time and hash.
+func (st fileState) written(old fileState) bool {
+	return st.size != old.size ||
+		st.mode.IsDir() != old.mode.IsDir() ||
+		!st.mtime.Equal(old.mtime) ||
+		!bytes.Equal(st.hash, old.hash)
+}
+
+// changed returns whether the file changed in any way which diff
+// reports.
+func (st fileState) changed(old fileState) bool {
+	return st.replaced(old) || st.written(old) || st.mode != old.mode || !st.ctime.Equal(old.ctime)
+}
+
+// diff returns the operation which changed each path between the two
+// scans. A file renamed to another watched path, found by its inode, is
+// reported once at its new path.
+func diff(prev, files map[string]fileState) map[string]Op {
+	changed := make(map[string]Op)
+	for path, st := range files {
+		old, ok := prev[path]
+		switch {
+		case !ok:
+			changed[path] = OpCreate
+		case st.replaced(old):
+			changed[path] = OpCreate | OpWrite
+		case st.mode.IsDir() && old.mode.IsDir() && st.mode == old.mode:
+			// A directory's contents are watched through its entries.
+		case st.written(old):
+			changed[path] = OpWrite
+		case st.mode != old.mode:
+			changed[path] = OpChmod
+		case !st.ctime.Equal(old.ctime):
+			// Only the metadata changed, such as the owner, links or
+			// extended attributes, as fsnotify reports as a chmod.
+			// Contents rewritten with the same size and modification
+			// time, as by cp -p, are only seen with Hash.
+			changed[path] = OpChmod
+		}
+	}
+
+	type inode struct{ dev, ino uint64 }
+	gone := make(map[inode]string)
+	for path, old := range prev {
+		if _, ok := files[path]; !ok {
+			changed[path] = OpRemove
+			if old.ino != 0 {
+				gone[inode{old.dev, old.ino}] = path
+			}
+		}
+	}
+	for path, op := range changed {
+		if op&OpCreate == 0 {
+			continue
+		}
+		st := files[path]
+		if from, ok := gone[inode{st.dev, st.ino}]; ok && st.ino != 0 {
+			delete(changed, from)
+			changed[path] = op&OpWrite | OpRename
+		}
+	}
+	return changed
+}
+
+// scan stats the roots, and the entries of those which are directories,
+// using up to Workers goroutines. Files which disappear or cannot be
+// read during the scan are left out, as are directories whose entries
+// cannot be listed, so that only unexpected errors are returned.
+func (p *Poller) scan(roots []string) (map[string]fileState, error) {
+	var (
+		paths   = make(chan string)
+		mu      sync.Mutex
+		files   = make(map[string]fileState)
+		scanErr error
+		wg      sync.WaitGroup
+	)
+	workers := p.Workers
+	if workers < 1 {
+		workers = 1
+	}
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for path := range paths {
+				fi, err := os.Stat(path)
+				if err != nil {
 					continue
 				}
-				if status, ok := err.Sys().(syscall.WaitStatus); ok {
-					// Retry on bus error, as these are occasionally
-					// encountered when restarting a binary hosted on a
-					// docker volume.
-					if status.Signal() == syscall.SIGBUS {
-						_ = kill(p.bin, "retrying on bus error...")
-						p.sleep(p.Interval, p.watcher.Event)
+				st := newFileState(fi)
+				if p.Hash && fi.Mode().IsRegular() {
+					if st.hash = hashFile(path); st.hash == nil {
 						continue
 					}
-					exitCode = status.ExitStatus()
-				} else {
-					exitCode = 1
 				}
+				mu.Lock()
+				files[path] = st
+				mu.Unlock()
 			}
-			os.Exit(exitCode)
-		case <-p.watcher.Closed:
-			_ = kill(p.bin, "executable quit; reloading...")
-			return
+		}()
+	}
+
+	for _, root := range roots {
+		root = filepath.Clean(root)
+		paths <- root
+		names, err := readDirNames(root)
+		if err != nil && !os.IsNotExist(err) && !os.IsPermission(err) {
+			scanErr = err
+		}
+		for _, name := range names {
+			paths <- filepath.Join(root, name)
 		}
 	}
+	close(paths)
+	wg.Wait()
+	return files, scanErr
 }
 
-// Deprecated: please use github.com/cosmtrek/air or another tool instead.
-func (p *Poller) Start() error {
-	return errors.Wrap(p.watcher.Start(p.Interval), "poller.Start")
+// readDirNames returns the names of the entries of the given directory,
+// or nothing if it is not a directory or no longer exists.
+func readDirNames(path string) ([]string, error) {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil || !fi.IsDir() {
+		return nil, err
+	}
+	return f.Readdirnames(-1)
 }
 
-// Deprecated: please use github.com/cosmtrek/air or another tool instead.
-func (p *Poller) Close() error {
-	p.watcher.Close()
-	return nil
+// hashFile returns a hash of the contents of the file, or nothing if it
+// cannot be read.
+func hashFile(path string) []byte {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return nil
+	}
+	return h.Sum(nil)
 }
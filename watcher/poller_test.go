@@ -0,0 +1,270 @@
+package watcher
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+)
+
+// newTestPoller returns a Poller whose changes are buffered, so that
+// poll can be called directly.
+func newTestPoller() *Poller {
+	p := NewPoller(false, 0, "true", nil)
+	p.changes = make(chan string, 100)
+	return p
+}
+
+// polled polls once and returns the changes forwarded.
+func polled(p *Poller) []string {
+	p.poll()
+	var paths []string
+	for {
+		select {
+		case path := <-p.changes:
+			paths = append(paths, path)
+		default:
+			return paths
+		}
+	}
+}
+
+// chdirTemp changes to a new temporary directory, returning a function
+// which changes back and removes it.
+func chdirTemp(t *testing.T) func() {
+	dir, err := ioutil.TempDir("", "poller")
+	if err != nil {
+		t.Fatal(err)
+	}
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	return func() {
+		_ = os.Chdir(wd)
+		_ = os.RemoveAll(dir)
+	}
+}
+
+func writeFile(t *testing.T, path, contents string) {
+	if err := ioutil.WriteFile(path, []byte(contents), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestPollRoots(t *testing.T) {
+	for _, root := range []string{"dir", "./dir", "dir/", "./dir/"} {
+		t.Run(root, func(t *testing.T) {
+			defer chdirTemp(t)()
+			if err := os.Mkdir("dir", 0755); err != nil {
+				t.Fatal(err)
+			}
+			writeFile(t, filepath.Join("dir", "a"), "a")
+
+			p := newTestPoller()
+			if err := p.Add(root); err != nil {
+				t.Fatal(err)
+			}
+			for i := 0; i < 2; i++ {
+				if changed := polled(p); len(changed) > 0 {
+					t.Fatalf("poll %d of an unchanged tree reported %q", i+1, changed)
+				}
+			}
+			writeFile(t, filepath.Join("dir", "b"), "b")
+			want := []string{filepath.Join("dir", "b")}
+			if changed := polled(p); !reflect.DeepEqual(changed, want) {
+				t.Errorf("poll after a write reported %q, want %q", changed, want)
+			}
+			if err := p.Remove(root); err != nil {
+				t.Errorf("Remove(%q) failed: %v", root, err)
+			}
+			if n := p.watched(); n != 0 {
+				t.Errorf("%d files watched after Remove, want none", n)
+			}
+		})
+	}
+}
+
+func TestDiff(t *testing.T) {
+	t0 := time.Unix(1000, 0)
+	file := fileState{size: 1, mode: 0644, mtime: t0, ctime: t0, dev: 1, ino: 10}
+	with := func(st fileState, f func(*fileState)) fileState {
+		f(&st)
+		return st
+	}
+	dir := fileState{mode: os.ModeDir | 0755, mtime: t0, ctime: t0, dev: 1, ino: 20}
+
+	tests := []struct {
+		name        string
+		prev, files map[string]fileState
+		want        map[string]Op
+	}{
+		{
+			name:  "unchanged",
+			prev:  map[string]fileState{"a": file},
+			files: map[string]fileState{"a": file},
+			want:  map[string]Op{},
+		},
+		{
+			name:  "created",
+			prev:  map[string]fileState{},
+			files: map[string]fileState{"a": file},
+			want:  map[string]Op{"a": OpCreate},
+		},
+		{
+			name:  "removed",
+			prev:  map[string]fileState{"a": file},
+			files: map[string]fileState{},
+			want:  map[string]Op{"a": OpRemove},
+		},
+		{
+			name:  "size",
+			prev:  map[string]fileState{"a": file},
+			files: map[string]fileState{"a": with(file, func(st *fileState) { st.size = 2 })},
+			want:  map[string]Op{"a": OpWrite},
+		},
+		{
+			name:  "mtime",
+			prev:  map[string]fileState{"a": file},
+			files: map[string]fileState{"a": with(file, func(st *fileState) { st.mtime = t0.Add(time.Nanosecond) })},
+			want:  map[string]Op{"a": OpWrite},
+		},
+		{
+			name:  "hash",
+			prev:  map[string]fileState{"a": with(file, func(st *fileState) { st.hash = []byte{1} })},
+			files: map[string]fileState{"a": with(file, func(st *fileState) { st.hash = []byte{2} })},
+			want:  map[string]Op{"a": OpWrite},
+		},
+		{
+			name:  "mode",
+			prev:  map[string]fileState{"a": file},
+			files: map[string]fileState{"a": with(file, func(st *fileState) { st.mode = 0600 })},
+			want:  map[string]Op{"a": OpChmod},
+		},
+		{
+			name:  "ctime",
+			prev:  map[string]fileState{"a": file},
+			files: map[string]fileState{"a": with(file, func(st *fileState) { st.ctime = t0.Add(time.Second) })},
+			want:  map[string]Op{"a": OpChmod},
+		},
+		{
+			name:  "replaced",
+			prev:  map[string]fileState{"a": file},
+			files: map[string]fileState{"a": with(file, func(st *fileState) { st.ino = 11 })},
+			want:  map[string]Op{"a": OpCreate | OpWrite},
+		},
+		{
+			name:  "renamed",
+			prev:  map[string]fileState{"a": file},
+			files: map[string]fileState{"b": file},
+			want:  map[string]Op{"b": OpRename},
+		},
+		{
+			name:  "renamed over",
+			prev:  map[string]fileState{"a": file, "b": with(file, func(st *fileState) { st.ino = 11 })},
+			files: map[string]fileState{"b": file},
+			want:  map[string]Op{"b": OpWrite | OpRename},
+		},
+		{
+			name:  "renamed without inodes",
+			prev:  map[string]fileState{"a": with(file, func(st *fileState) { st.ino = 0 })},
+			files: map[string]fileState{"b": with(file, func(st *fileState) { st.ino = 0 })},
+			want:  map[string]Op{"a": OpRemove, "b": OpCreate},
+		},
+		{
+			name:  "directory entries changed",
+			prev:  map[string]fileState{"d": dir},
+			files: map[string]fileState{"d": with(dir, func(st *fileState) { st.mtime, st.size = t0.Add(time.Second), 2 })},
+			want:  map[string]Op{},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := diff(test.prev, test.files); !reflect.DeepEqual(got, test.want) {
+				t.Errorf("diff() = %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestPollHeldRemoval(t *testing.T) {
+	defer chdirTemp(t)()
+	if err := os.Mkdir("dir", 0755); err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join("dir", "a")
+	writeFile(t, path, "a")
+	p := newTestPoller()
+	if err := p.Add("dir"); err != nil {
+		t.Fatal(err)
+	}
+
+	// A file deleted and recreated is a single change.
+	if err := os.Remove(path); err != nil {
+		t.Fatal(err)
+	}
+	if changed := polled(p); len(changed) > 0 {
+		t.Fatalf("poll after a removal reported %q, want it held", changed)
+	}
+	writeFile(t, path, "aa")
+	if changed := polled(p); !reflect.DeepEqual(changed, []string{path}) {
+		t.Fatalf("poll after recreating reported %q, want %q", changed, path)
+	}
+	if changed := polled(p); len(changed) > 0 {
+		t.Fatalf("poll after the change reported %q", changed)
+	}
+
+	// A file which stays deleted is reported a poll later.
+	if err := os.Remove(path); err != nil {
+		t.Fatal(err)
+	}
+	if changed := polled(p); len(changed) > 0 {
+		t.Fatalf("poll after a removal reported %q, want it held", changed)
+	}
+	if changed := polled(p); !reflect.DeepEqual(changed, []string{path}) {
+		t.Fatalf("second poll after a removal reported %q, want %q", changed, path)
+	}
+}
+
+func TestPollerCovered(t *testing.T) {
+	p := newTestPoller()
+	p.roots = []string{"a", "b/c", "./e/"}
+	var files = make(map[string]fileState)
+	for _, path := range []string{"a", "a/x", "a/x/y", "b", "b/c", "b/c/z", "d", "e/f"} {
+		files[filepath.FromSlash(path)] = fileState{}
+	}
+	var kept []string
+	for path := range p.covered(files) {
+		kept = append(kept, filepath.ToSlash(path))
+	}
+	sort.Strings(kept)
+	want := []string{"a", "a/x", "b/c", "b/c/z", "e/f"}
+	if !reflect.DeepEqual(kept, want) {
+		t.Errorf("covered() = %q, want %q", kept, want)
+	}
+}
+
+func TestPollHashUnreadable(t *testing.T) {
+	if os.Geteuid() == 0 {
+		t.Skip("files are always readable by root")
+	}
+	defer chdirTemp(t)()
+	writeFile(t, "a", "a")
+	if err := os.Chmod("a", 0); err != nil {
+		t.Fatal(err)
+	}
+	p := newTestPoller()
+	p.Hash = true
+	if err := p.Add("a"); err != nil {
+		t.Fatal(err)
+	}
+	if n := p.watched(); n != 0 {
+		t.Errorf("%d files watched, want the unreadable one left out", n)
+	}
+}
@@ -0,0 +1,139 @@
+package watcher
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os/exec"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Probe checks whether the supervised command is healthy, using one of
+// an HTTP GET, a TCP connect or an exec'd command.
+type Probe struct {
+	// HTTP is a URL which must answer a GET with a 2xx status.
+	HTTP string
+	// TCP is an address which must accept a connection.
+	TCP string
+	// Exec is a command which must exit with a zero status.
+	Exec []string
+
+	Interval         time.Duration
+	Timeout          time.Duration
+	InitialDelay     time.Duration
+	SuccessThreshold int
+	FailureThreshold int
+}
+
+// ParseProbe returns a Probe for the given spec, which is one of
+// "http://...", "https://...", "tcp://host:port" or "exec:command args".
+func ParseProbe(spec string) (*Probe, error) {
+	p := &Probe{
+		Interval:         time.Second,
+		Timeout:          time.Second,
+		SuccessThreshold: 1,
+		FailureThreshold: 3,
+	}
+	switch {
+	case strings.HasPrefix(spec, "http://"), strings.HasPrefix(spec, "https://"):
+		p.HTTP = spec
+	case strings.HasPrefix(spec, "tcp://"):
+		p.TCP = strings.TrimPrefix(spec, "tcp://")
+	case strings.HasPrefix(spec, "exec:"):
+		p.Exec = strings.Fields(strings.TrimPrefix(spec, "exec:"))
+		if len(p.Exec) == 0 {
+			return nil, errors.Errorf("probe %q has no command", spec)
+		}
+	default:
+		return nil, errors.Errorf("unknown probe %q", spec)
+	}
+	return p, nil
+}
+
+// String returns the target of the probe.
+func (p *Probe) String() string {
+	switch {
+	case p.HTTP != "":
+		return p.HTTP
+	case p.TCP != "":
+		return "tcp://" + p.TCP
+	default:
+		return "exec:" + strings.Join(p.Exec, " ")
+	}
+}
+
+// Check runs the probe once, returning an error if it failed.
+func (p *Probe) Check() error {
+	ctx, cancel := context.WithTimeout(context.Background(), p.Timeout)
+	defer cancel()
+
+	switch {
+	case p.HTTP != "":
+		req, err := http.NewRequest("GET", p.HTTP, nil)
+		if err != nil {
+			return err
+		}
+		resp, err := http.DefaultClient.Do(req.WithContext(ctx))
+		if err != nil {
+			return err
+		}
+		_, _ = io.Copy(ioutil.Discard, resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode < 200 || resp.StatusCode > 299 {
+			return errors.Errorf("GET %s: %s", p.HTTP, resp.Status)
+		}
+		return nil
+	case p.TCP != "":
+		var d net.Dialer
+		conn, err := d.DialContext(ctx, "tcp", p.TCP)
+		if err != nil {
+			return err
+		}
+		return conn.Close()
+	default:
+		return exec.CommandContext(ctx, p.Exec[0], p.Exec[1:]...).Run()
+	}
+}
+
+// run checks the probe every Interval until stop is closed, calling fn
+// whenever the probe crosses a threshold. The probe starts out in the
+// given state, so fn is first called once it changes.
+func (p *Probe) run(healthy bool, stop <-chan struct{}, fn func(healthy bool, err error)) {
+	select {
+	case <-time.After(p.InitialDelay):
+	case <-stop:
+		return
+	}
+
+	ticker := time.NewTicker(p.Interval)
+	defer ticker.Stop()
+
+	var successes, failures int
+	for {
+		err := p.Check()
+		if err == nil {
+			successes, failures = successes+1, 0
+			if !healthy && successes >= p.SuccessThreshold {
+				healthy = true
+				fn(healthy, nil)
+			}
+		} else {
+			successes, failures = 0, failures+1
+			if healthy && failures >= p.FailureThreshold {
+				healthy = false
+				fn(healthy, err)
+			}
+		}
+
+		select {
+		case <-ticker.C:
+		case <-stop:
+			return
+		}
+	}
+}
@@ -0,0 +1,149 @@
+package watcher
+
+import (
+	"html/template"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Proxy is a reverse proxy to the supervised command. Requests are held
+// while the command restarts until it is ready, and the build output is
+// shown instead if its build failed.
+type Proxy struct {
+	// Timeout is how long a request is held before giving up.
+	Timeout time.Duration
+
+	// LiveReload, if set, is served at LiveReloadPath, and its script is
+	// injected into every HTML page.
+	LiveReload *LiveReload
+
+	proxy *httputil.ReverseProxy
+
+	mu      sync.Mutex
+	ready   bool
+	output  []byte        // the output of the failed build, if any
+	changed chan struct{} // closed whenever the state changes
+}
+
+// NewProxy returns a Proxy to the given upstream address or URL, which
+// follows the state of the command from the given events.
+func NewProxy(upstream string, events <-chan Event) (*Proxy, error) {
+	u, err := url.Parse(UpstreamURL(upstream))
+	if err != nil {
+		return nil, errors.Wrapf(err, "invalid upstream %s", upstream)
+	}
+	p := &Proxy{
+		Timeout: 30 * time.Second,
+		proxy:   httputil.NewSingleHostReverseProxy(u),
+		changed: make(chan struct{}),
+	}
+
+	// Ask for uncompressed pages, so the script can be injected.
+	director := p.proxy.Director
+	p.proxy.Director = func(r *http.Request) {
+		director(r)
+		if p.LiveReload != nil {
+			r.Header.Del("Accept-Encoding")
+		}
+	}
+	p.proxy.ModifyResponse = func(resp *http.Response) error {
+		if p.LiveReload == nil {
+			return nil
+		}
+		return injectLiveReload(resp)
+	}
+
+	go p.follow(events)
+	return p, nil
+}
+
+// UpstreamURL returns the URL for the given upstream, which may be a
+// bare address such as ":8080".
+func UpstreamURL(upstream string) string {
+	if strings.Contains(upstream, "://") {
+		return upstream
+	}
+	if strings.HasPrefix(upstream, ":") {
+		upstream = "localhost" + upstream
+	}
+	return "http://" + upstream
+}
+
+// follow updates the state of the proxy from the given events.
+func (p *Proxy) follow(events <-chan Event) {
+	for e := range events {
+		p.mu.Lock()
+		switch e.Type {
+		case EventReady:
+			p.ready, p.output = true, nil
+		case EventBuildFailed:
+			p.ready, p.output = false, e.Output
+		case EventStarted, EventChanged:
+			p.ready, p.output = false, nil
+		case EventExited, EventUnready, EventUnhealthy:
+			p.ready = false
+		}
+		close(p.changed)
+		p.changed = make(chan struct{})
+		p.mu.Unlock()
+	}
+}
+
+// ServeHTTP proxies the request once the command is ready.
+func (p *Proxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if p.LiveReload != nil && strings.HasPrefix(r.URL.Path, LiveReloadPath) {
+		p.LiveReload.ServeHTTP(w, r)
+		return
+	}
+
+	timeout := time.After(p.Timeout)
+	for {
+		p.mu.Lock()
+		ready, output, changed := p.ready, p.output, p.changed
+		p.mu.Unlock()
+
+		switch {
+		case output != nil:
+			w.Header().Set("Content-Type", "text/html; charset=utf-8")
+			w.WriteHeader(http.StatusBadGateway)
+			_ = buildFailedPage.Execute(w, string(output))
+			return
+		case ready:
+			p.proxy.ServeHTTP(w, r)
+			return
+		}
+
+		select {
+		case <-changed:
+		case <-timeout:
+			http.Error(w, "timed out waiting for the upstream to be ready", http.StatusServiceUnavailable)
+			return
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+// buildFailedPage is shown in place of the upstream if its build failed.
+var buildFailedPage = template.Must(template.New("").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<title>Build failed</title>
+<style>
+body { font-family: sans-serif; margin: 2em; }
+pre { background: #fdd; padding: 1em; overflow: auto; }
+</style>
+</head>
+<body>
+<h1>Build failed</h1>
+<p>The page will be served again once the build is fixed.</p>
+<pre>{{.}}</pre>
+</body>
+</html>
+`))
@@ -0,0 +1,258 @@
+package watcher
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/pkg/errors"
+)
+
+// Actions for a changed path, from the weakest to the strongest.
+const (
+	// ActionNone does nothing.
+	ActionNone = "none"
+	// ActionExec runs a command.
+	ActionExec = "exec"
+	// ActionSignal sends a signal to the command.
+	ActionSignal = "signal"
+	// ActionRestart restarts the command without building it.
+	ActionRestart = "restart"
+	// ActionRebuild builds and restarts the command, which is what a
+	// change does without rules.
+	ActionRebuild = "rebuild"
+)
+
+// actionStrength orders the actions, so that the strongest wins.
+var actionStrength = map[string]int{
+	ActionNone:    0,
+	ActionExec:    1,
+	ActionSignal:  2,
+	ActionRestart: 3,
+	ActionRebuild: 4,
+}
+
+// signals are the signals which may be named in a rule, along with
+// userSignals.
+var signals = map[string]syscall.Signal{
+	"HUP":  syscall.SIGHUP,
+	"INT":  syscall.SIGINT,
+	"QUIT": syscall.SIGQUIT,
+	"TERM": syscall.SIGTERM,
+	"KILL": syscall.SIGKILL,
+}
+
+// Rule decides what a change to a path matching Pattern does.
+type Rule struct {
+	// Pattern is matched against the changed path as with
+	// filepath.Match, or against its base name if it has no
+	// separator. A pattern ending in "/**" matches everything under
+	// the directory. Both are cleaned, and a relative pattern is
+	// matched against the path relative to the working directory.
+	Pattern string
+
+	// Action is one of the Action constants.
+	Action string
+
+	// Signal is sent to the command, for ActionSignal.
+	Signal syscall.Signal
+
+	// Command is run, for ActionExec, with AUTORELOADER_CHANGED_PATHS
+	// set to the changed paths.
+	Command []string
+}
+
+// ParseRule returns the Rule for the given spec, which is
+// "pattern=action", where the action is one of "none", "restart",
+// "rebuild", "signal:NAME" or "exec:command args".
+func ParseRule(spec string) (*Rule, error) {
+	i := strings.Index(spec, "=")
+	if i <= 0 {
+		return nil, errors.Errorf("rule %q is not pattern=action", spec)
+	}
+	r := &Rule{Pattern: spec[:i]}
+	if _, err := filepath.Match(r.Pattern, ""); err != nil {
+		return nil, errors.Wrapf(err, "invalid pattern in rule %q", spec)
+	}
+
+	action := spec[i+1:]
+	switch {
+	case action == ActionNone, action == ActionRestart, action == ActionRebuild:
+		r.Action = action
+	case strings.HasPrefix(action, ActionSignal+":"):
+		r.Action = ActionSignal
+		sig, err := parseSignal(strings.TrimPrefix(action, ActionSignal+":"))
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid rule %q", spec)
+		}
+		r.Signal = sig
+	case strings.HasPrefix(action, ActionExec+":"):
+		r.Action = ActionExec
+		r.Command = strings.Fields(strings.TrimPrefix(action, ActionExec+":"))
+		if len(r.Command) == 0 {
+			return nil, errors.Errorf("rule %q has no command", spec)
+		}
+	default:
+		return nil, errors.Errorf("unknown action in rule %q", spec)
+	}
+	return r, nil
+}
+
+// parseSignal returns the signal with the given name, such as "HUP" or
+// "SIGHUP", or number.
+func parseSignal(name string) (syscall.Signal, error) {
+	key := strings.TrimPrefix(strings.ToUpper(name), "SIG")
+	if sig, ok := signals[key]; ok {
+		return sig, nil
+	}
+	if sig, ok := userSignals[key]; ok {
+		return sig, nil
+	}
+	if n, err := strconv.Atoi(name); err == nil && n > 0 {
+		return syscall.Signal(n), nil
+	}
+	return 0, errors.Errorf("unknown signal %q", name)
+}
+
+// signalName returns the name of the signal, such as "HUP".
+func signalName(sig syscall.Signal) string {
+	for _, m := range []map[string]syscall.Signal{signals, userSignals} {
+		for name, s := range m {
+			if s == sig {
+				return name
+			}
+		}
+	}
+	return strconv.Itoa(int(sig))
+}
+
+// String returns the action of the rule.
+func (r *Rule) String() string {
+	switch r.Action {
+	case ActionSignal:
+		return ActionSignal + ":" + signalName(r.Signal)
+	case ActionExec:
+		return ActionExec + ":" + strings.Join(r.Command, " ")
+	default:
+		return r.Action
+	}
+}
+
+// Match returns whether the rule applies to the changed path.
+func (r *Rule) Match(path string) bool {
+	pattern, path := filepath.Clean(r.Pattern), filepath.Clean(path)
+	if filepath.IsAbs(path) && !filepath.IsAbs(pattern) {
+		if wd, err := os.Getwd(); err == nil {
+			if rel, err := filepath.Rel(wd, path); err == nil && !strings.HasPrefix(rel, "..") {
+				path = rel
+			}
+		}
+	}
+	pattern, path = filepath.ToSlash(pattern), filepath.ToSlash(path)
+	if dir := strings.TrimSuffix(pattern, "/**"); dir != pattern {
+		return path == dir || strings.HasPrefix(path, dir+"/")
+	}
+	if !strings.Contains(pattern, "/") {
+		path = filepath.Base(path)
+	}
+	ok, _ := filepath.Match(pattern, path)
+	return ok
+}
+
+// defaultRule is the rule for paths which match none of the rules.
+var defaultRule = &Rule{Action: ActionRebuild}
+
+// ruleMatch is a rule matched by a changed path.
+type ruleMatch struct {
+	rule *Rule
+	path string
+}
+
+// match returns the strongest of the rules matched by the changed paths,
+// each path matching its first rule. Several rules are returned if they
+// are equally strong.
+func (s *Supervisor) match(paths []string) []ruleMatch {
+	var matches []ruleMatch
+	for _, path := range paths {
+		rule := defaultRule
+		for _, r := range s.Rules {
+			if r.Match(path) {
+				rule = r
+				break
+			}
+		}
+
+		if len(matches) > 0 {
+			strongest := actionStrength[matches[0].rule.Action]
+			if actionStrength[rule.Action] < strongest {
+				continue
+			}
+			if actionStrength[rule.Action] > strongest {
+				matches = nil
+			}
+		}
+		if !matched(matches, rule) {
+			matches = append(matches, ruleMatch{rule, path})
+		}
+	}
+	return matches
+}
+
+// matched returns whether the rule is one of the matches.
+func matched(matches []ruleMatch, rule *Rule) bool {
+	for _, m := range matches {
+		if m.rule == rule {
+			return true
+		}
+	}
+	return false
+}
+
+// act carries out the strongest action of the rules matched by the
+// changed paths, returning whether the command should be restarted.
+// The process is nil if the command is not running, in which case
+// there is nothing to signal.
+func (s *Supervisor) act(proc *process) bool {
+	matches := s.match(s.changed)
+	switch matches[0].rule.Action {
+	case ActionRebuild:
+		return true
+	case ActionRestart:
+		s.noBuild = true
+		return true
+	}
+
+	paths := s.changed
+	s.changed = nil
+	for _, m := range matches {
+		e := Event{Type: EventAction, Path: m.path, Action: m.rule.String()}
+		switch m.rule.Action {
+		case ActionNone:
+			s.emit(LevelDebug, "change ignored", e)
+		case ActionSignal:
+			if proc == nil {
+				continue
+			}
+			e.PID = proc.cmd.Process.Pid
+			s.emit(LevelInfo, "executable changed; signalling...", e)
+			if err := proc.cmd.Process.Signal(m.rule.Signal); err != nil {
+				s.Log.Error("failed to signal executable", Fields{"error": err.Error()})
+			}
+		case ActionExec:
+			s.emit(LevelInfo, "executable changed; running command...", e)
+			cmd := exec.Command(m.rule.Command[0], m.rule.Command[1:]...)
+			cmd.Stdout = os.Stdout
+			cmd.Stderr = os.Stderr
+			cmd.Env = append(os.Environ(),
+				"AUTORELOADER_CHANGED_PATHS="+strings.Join(paths, string(os.PathListSeparator)),
+			)
+			if err := cmd.Run(); err != nil {
+				s.Log.Error("command failed", Fields{"command": m.rule.String(), "error": err.Error()})
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,56 @@
+package watcher
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestRuleMatch(t *testing.T) {
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		pattern string
+		path    string
+		match   bool
+	}{
+		// Patterns without a separator match the base name.
+		{"*.go", "main.go", true},
+		{"*.go", "cmd/server/main.go", true},
+		{"*.go", "main.go.orig", false},
+		{"go.mod", "vendor/x/go.mod", true},
+
+		// Patterns with a separator match the whole path.
+		{"config/*.yml", "config/app.yml", true},
+		{"config/*.yml", "config/dev/app.yml", false},
+		{"config/*.yml", "other/config/app.yml", false},
+
+		// Patterns and paths are cleaned, and absolute paths are made
+		// relative to the working directory.
+		{"./config/*.yml", "config/app.yml", true},
+		{"config/*.yml", "./config/app.yml", true},
+		{"templates/**", "./templates/x.html", true},
+		{"config/", "config", true},
+		{"config/*.yml", filepath.Join(wd, "config", "app.yml"), true},
+		{"templates/**", filepath.Join(wd, "templates", "a", "x.html"), true},
+		{"*.yml", filepath.Join(wd, "..", "config", "app.yml"), true},
+		{"config/*.yml", filepath.Join(filepath.Dir(wd), "config", "app.yml"), false},
+		{filepath.Join(wd, "config", "*.yml"), filepath.Join(wd, "config", "app.yml"), true},
+
+		// Patterns ending in /** match everything under the directory.
+		{"assets/**", "assets", true},
+		{"assets/**", "assets/css/app.css", true},
+		{"assets/**", "assets.go", false},
+		{"assets/**", "public/assets/app.css", false},
+
+		{"[", "[", false},
+	}
+	for _, test := range tests {
+		r := &Rule{Pattern: test.pattern}
+		if match := r.Match(test.path); match != test.match {
+			t.Errorf("Rule{Pattern: %q}.Match(%q) = %t, want %t", test.pattern, test.path, match, test.match)
+		}
+	}
+}
@@ -0,0 +1,10 @@
+//go:build !darwin && !dragonfly && !freebsd && !linux && !netbsd && !openbsd
+// +build !darwin,!dragonfly,!freebsd,!linux,!netbsd,!openbsd
+
+package watcher
+
+import "syscall"
+
+// userSignals are the signals left for applications, of which there
+// are none on this platform.
+var userSignals = map[string]syscall.Signal{}
@@ -0,0 +1,13 @@
+//go:build darwin || dragonfly || freebsd || linux || netbsd || openbsd
+// +build darwin dragonfly freebsd linux netbsd openbsd
+
+package watcher
+
+import "syscall"
+
+// userSignals are the signals left for applications, which may be
+// named in a Rule.
+var userSignals = map[string]syscall.Signal{
+	"USR1": syscall.SIGUSR1,
+	"USR2": syscall.SIGUSR2,
+}
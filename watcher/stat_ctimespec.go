@@ -0,0 +1,19 @@
+//go:build darwin || freebsd || netbsd
+// +build darwin freebsd netbsd
+
+package watcher
+
+import (
+	"os"
+	"syscall"
+	"time"
+)
+
+// statSys returns the device, inode and change time of the file.
+func statSys(fi os.FileInfo) (dev, ino uint64, ctime time.Time) {
+	st, ok := fi.Sys().(*syscall.Stat_t)
+	if !ok {
+		return 0, 0, time.Time{}
+	}
+	return uint64(st.Dev), uint64(st.Ino), time.Unix(st.Ctimespec.Unix())
+}
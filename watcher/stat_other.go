@@ -0,0 +1,15 @@
+//go:build !darwin && !dragonfly && !freebsd && !linux && !netbsd && !openbsd
+// +build !darwin,!dragonfly,!freebsd,!linux,!netbsd,!openbsd
+
+package watcher
+
+import (
+	"os"
+	"time"
+)
+
+// statSys returns nothing on this platform, where files are compared
+// by size, mode and modification time alone.
+func statSys(fi os.FileInfo) (dev, ino uint64, ctime time.Time) {
+	return 0, 0, time.Time{}
+}
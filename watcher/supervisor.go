@@ -0,0 +1,714 @@
+package watcher
+
+import (
+	"io"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Supervisor runs a command and restarts it whenever its watcher
+// reports a change. It holds the settings shared by Notifier and
+// Poller.
+type Supervisor struct {
+	// watchEvents is the number of changes reported by the backend. It
+	// is accessed atomically, so comes first for alignment.
+	watchEvents int64
+
+	Autorestart bool
+	Interval    time.Duration
+	Cmd         string
+	Args        []string
+
+	// Ops are the filesystem operations which count as a change, which
+	// are DefaultOps unless set before Start.
+	Ops Op
+
+	// Log receives the supervisor's own messages, which go to stderr
+	// as text by default.
+	Log *Logger
+
+	// Output, if set, formats the command's output line by line.
+	Output *Output
+
+	// LogFile, if set, receives a copy of the command's output.
+	LogFile *LogFile
+
+	// Tail, if set, keeps the most recent lines of the command's
+	// output, which are served by Control.
+	Tail *Tail
+
+	// Readiness, if set, is checked while the command runs to report
+	// when it is serving.
+	Readiness *Probe
+
+	// Liveness, if set, is checked while the command runs. Once it
+	// fails, the command is killed and handled as if it had crashed.
+	Liveness *Probe
+
+	// Build, if set, is run before every generation of the command is
+	// started. If it fails, the command is not started until the next
+	// change.
+	Build []string
+
+	// Pipeline, if set, is run instead of Build.
+	Pipeline *Pipeline
+
+	// Quickfix, if set, is the path of a file which the errors of every
+	// failed build are written to, in the format read by vim's
+	// :cfile. It is emptied once a build succeeds.
+	Quickfix string
+
+	// Listeners, if set, are passed to every generation of the command
+	// using systemd's socket activation protocol. When the command
+	// changes, the new generation is started first, and the previous
+	// one is stopped once the new one is ready. The command is started
+	// by re-executing the supervisor's own program, whose main must
+	// call ExecListenShim before doing anything else.
+	Listeners []*os.File
+
+	// Hooks, if set, are run around every generation of the command.
+	Hooks *Hooks
+
+	// GoPackages, if set, are the packages of the command, changes to
+	// files under whose directories are ignored unless they are built
+	// from.
+	GoPackages *GoPackages
+
+	// Tests, if set, are run for the packages of the changed files
+	// before the command is restarted, which it is not if they fail.
+	Tests *Tests
+
+	// Rules, if set, decide what changes do. Changes arriving within
+	// the Interval are taken together, each path taking the action of
+	// the first rule it matches, or ActionRebuild if none, and the
+	// strongest action wins.
+	Rules []*Rule
+
+	// Dir, if set, is the working directory of the command. The build
+	// and hooks are still run in the supervisor's.
+	Dir string
+
+	credential *credential // the user to run the command as, set by RunAs
+
+	name   string        // the name of the binary in events, set by Monorepo
+	builds chan struct{} // limits the builds run at once, if set
+
+	reason   string          // why the next generation is started
+	noBuild  bool            // whether to skip the build for the next generation
+	changed  []string        // the paths whose changes started the next generation
+	untested []string        // the changed paths whose tests last failed
+	proc     *process        // the current generation
+	prev     *process        // the generation to stop once proc is ready
+	retiring *sync.WaitGroup // previous generations which are stopping
+
+	// watched returns the number of files and directories whose
+	// changes are reported, as set by the backend: each watched path
+	// and its entries, or everything under it with Fanotify.
+	watched func() int
+
+	requests chan request  // operations from the control API
+	starting chan error    // the reply to send once the next generation starts
+	resumed  chan struct{} // signalled when watching is resumed
+	finished chan struct{} // closed once supervise returns
+
+	mu          *sync.Mutex // protects the following
+	generation  int         // the number of generations started
+	exited      int         // the last generation to exit
+	exitCode    int         // its exit code
+	paused      bool
+	status      Status
+	interactive bool     // whether stdin is read by Interactive
+	stdin       *os.File // the current generation's stdin, if interactive
+	restoreTerm func()   // restores the terminal, if interactive
+	subscribers []chan Event
+}
+
+// stopGrace is how long a previous generation is given to exit after
+// SIGTERM before it is killed.
+const stopGrace = 5 * time.Second
+
+// process is a single generation of the supervised command.
+type process struct {
+	cmd        *exec.Cmd
+	generation int
+	started    time.Time
+	err        error         // the result of Wait, set before done is closed
+	done       chan struct{} // closed once the process has exited
+}
+
+// terminate asks the process to exit, killing it if it has not done so
+// after the given grace period.
+func (p *process) terminate(grace time.Duration) {
+	_ = p.cmd.Process.Signal(syscall.SIGTERM)
+	select {
+	case <-p.done:
+	case <-time.After(grace):
+		_ = p.cmd.Process.Kill()
+		<-p.done
+	}
+}
+
+// exitStatus returns the exit code of the process, which has exited,
+// and the signal which killed it, if any.
+func (p *process) exitStatus() (code int, signal syscall.Signal) {
+	if err, ok := p.err.(*exec.ExitError); ok {
+		code = 1
+		if status, ok := err.Sys().(syscall.WaitStatus); ok {
+			code = status.ExitStatus()
+			if status.Signaled() {
+				signal = status.Signal()
+			}
+		}
+	}
+	return code, signal
+}
+
+// newSupervisor returns a Supervisor with the given parameters,
+// defaulting the interval to 250ms.
+func newSupervisor(autorestart bool, interval int, cmd string, args []string) Supervisor {
+	if interval == 0 {
+		interval = 250
+	}
+	return Supervisor{
+		Autorestart: autorestart,
+		Interval:    time.Duration(interval) * time.Millisecond,
+		Cmd:         cmd,
+		Args:        args,
+		Ops:         DefaultOps,
+		Log:         &Logger{Out: os.Stderr, Level: LevelInfo},
+		retiring:    new(sync.WaitGroup),
+		requests:    make(chan request),
+		resumed:     make(chan struct{}, 1),
+		finished:    make(chan struct{}),
+		mu:          new(sync.Mutex),
+	}
+}
+
+// supervise runs the command until closed is closed, restarting it
+// whenever a changed path arrives on changes.
+func (s *Supervisor) supervise(changes <-chan string, errs <-chan error, closed <-chan struct{}) {
+	defer close(s.finished)
+	s.reason = ReasonStart
+	forwarded := s.funnel(changes)
+	for s.run(forwarded, errs, closed) {
+	}
+}
+
+// funnel counts the changes from the backend, drops those which
+// GoPackages ignores and holds the rest back while paused, returning
+// the channel which they are forwarded on. Each path changed while
+// paused is forwarded once on resume, so that Rules and Tests see them
+// all.
+func (s *Supervisor) funnel(changes <-chan string) <-chan string {
+	forwarded := make(chan string)
+	go func() {
+		var pending []string
+		for {
+			select {
+			case path := <-changes:
+				atomic.AddInt64(&s.watchEvents, 1)
+				if s.GoPackages != nil && !s.GoPackages.change(path) {
+					continue
+				}
+				s.mu.Lock()
+				paused := s.paused
+				s.mu.Unlock()
+				if paused {
+					if !contains(pending, path) {
+						pending = append(pending, path)
+					}
+					continue
+				}
+				forwarded <- path
+			case <-s.resumed:
+				for _, path := range pending {
+					forwarded <- path
+				}
+				pending = nil
+			}
+		}
+	}()
+	return forwarded
+}
+
+// run starts the command once and waits for it to change, exit or be
+// closed, returning whether it should be started again.
+func (s *Supervisor) run(changes <-chan string, errs <-chan error, closed <-chan struct{}) bool {
+	noBuild := s.noBuild
+	s.noBuild = false
+	if (len(s.Build) > 0 || s.Pipeline != nil) && !noBuild {
+		if _, err := s.rebuild(); err != nil {
+			s.started(errors.Wrap(err, "build failed"))
+			return s.wait(changes, errs, closed, true)
+		}
+	}
+
+	s.mu.Lock()
+	generation := s.generation + 1
+	s.mu.Unlock()
+	env := hookEnv{generation: generation, reason: s.reason, paths: s.changed}
+	if err := s.hook(HookPreStart, env); err != nil && s.Hooks.OnFailure != HookIgnore {
+		s.started(err)
+		if s.Hooks.OnFailure == HookExit {
+			s.exit(1)
+		}
+		return s.wait(changes, errs, closed, true)
+	}
+
+	s.proc = s.start()
+	pid := s.proc.cmd.Process.Pid
+	s.emit(LevelDebug, "executable started", Event{Type: EventStarted, PID: pid, Reason: s.reason})
+	s.started(nil)
+	s.changed = nil
+
+	stop := make(chan struct{})
+	defer close(stop)
+	ready, unhealthy := s.probe(pid, stop)
+
+	// Run the post-start hook once this generation is ready.
+	hookFailed := make(chan struct{})
+	if s.Hooks != nil && len(s.Hooks.PostStart) > 0 {
+		env.pid = pid
+		go func() {
+			select {
+			case <-ready:
+			case <-stop:
+				return
+			}
+			if err := s.hook(HookPostStart, env); err != nil {
+				close(hookFailed)
+			}
+		}()
+	}
+
+	// Stop the previous generation once this one is ready.
+	if prev := s.prev; prev != nil {
+		s.prev = nil
+		s.retiring.Add(1)
+		go func(proc *process, env hookEnv) {
+			defer s.retiring.Done()
+			select {
+			case <-ready:
+			case <-proc.done:
+			}
+			s.stop(prev, stopGrace, env)
+		}(s.proc, hookEnv{reason: env.reason, paths: env.paths})
+	}
+
+	for {
+		select {
+		case path := <-changes:
+			s.changed = []string{path}
+			if len(s.Rules) > 0 || s.Tests != nil || s.Pipeline != nil {
+				s.sleep(s.Interval, changes)
+			}
+			if len(s.Rules) > 0 && !s.act(s.proc) {
+				continue
+			}
+			if !s.test() {
+				// A restart which the rules chose is not made, so
+				// the next change is built.
+				s.noBuild = false
+				continue
+			}
+
+			// A pipeline is run before the command is stopped, and
+			// only restarts it if the artefacts change. It is run
+			// again before the next generation starts, for any later
+			// changes, skipping the steps which have just run.
+			if s.Pipeline != nil && !s.noBuild {
+				changed, err := s.rebuild()
+				if err != nil {
+					continue
+				}
+				if !changed {
+					s.Log.Info("artefacts unchanged; not restarting", Fields{"pid": pid})
+					continue
+				}
+			}
+			e := Event{Type: EventChanged, PID: pid, Path: path, Uptime: s.proc.uptime()}
+			if len(s.Listeners) > 0 {
+				s.emit(LevelInfo, "executable changed; starting new generation...", e)
+			} else {
+				s.emit(LevelInfo, "executable changed; reloading...", e)
+			}
+			s.restart(ReasonChange, changes)
+			return true
+		case err := <-errs:
+			must(err, "error while polling files")
+		case err := <-unhealthy:
+			e := Event{Type: EventUnhealthy, PID: pid, Err: err, Uptime: s.proc.uptime()}
+			if s.Autorestart {
+				s.emit(LevelError, "liveness probe failed; reloading...", e)
+				s.stop(s.proc, 0, hookEnv{reason: ReasonHealth})
+				s.reason = ReasonHealth
+				s.sleep(s.Interval, changes)
+				return true
+			}
+			s.emit(LevelError, "liveness probe failed", e)
+			s.stop(s.proc, 0, hookEnv{reason: ReasonHealth})
+			s.exit(1)
+			return s.wait(changes, errs, closed, true)
+		case <-hookFailed:
+			hookFailed = nil
+			if s.Hooks.OnFailure == HookIgnore {
+				continue
+			}
+			s.emit(LevelInfo, "executable stopped; waiting for changes...", Event{Type: EventStopped, PID: pid, Uptime: s.proc.uptime()})
+			s.stop(s.proc, stopGrace, hookEnv{reason: reasonHookFailure})
+			if s.Hooks.OnFailure == HookExit {
+				s.exit(1)
+			}
+			return s.wait(changes, errs, closed, true)
+		case <-s.proc.done:
+			e := Event{Type: EventExited, PID: pid, Err: s.proc.err, Uptime: s.proc.uptime()}
+			code, signal := s.proc.exitStatus()
+			e.ExitCode = code
+			if signal != 0 {
+				e.Signal = signal.String()
+			}
+			s.stop(s.proc, 0, hookEnv{reason: reasonExit})
+			if e.ExitCode != 0 || e.Signal != "" {
+				if s.Autorestart {
+					s.emit(LevelWarn, "executable quit; reloading...", e)
+					s.reason = ReasonCrash
+					s.sleep(s.Interval, changes)
+					return true
+				}
+				// Retry on bus error, as these are occasionally
+				// encountered when restarting a binary hosted on a
+				// docker volume.
+				if signal == syscall.SIGBUS {
+					s.emit(LevelWarn, "retrying on bus error...", e)
+					s.reason = ReasonSIGBUS
+					s.sleep(s.Interval, changes)
+					return true
+				}
+			}
+			s.emit(LevelInfo, "executable quit", e)
+			s.exit(e.ExitCode)
+			return s.wait(changes, errs, closed, true)
+		case req := <-s.requests:
+			switch req.op {
+			case opStart:
+				req.reply <- errors.New("already running")
+				continue
+			case opStop:
+				s.emit(LevelInfo, "executable stopped", Event{Type: EventStopped, PID: pid, Uptime: s.proc.uptime()})
+				s.stop(s.proc, 0, hookEnv{reason: reasonStop})
+				req.reply <- nil
+				return s.wait(changes, errs, closed, false)
+			case opRebuild:
+				if len(s.Build) == 0 && s.Pipeline == nil {
+					req.reply <- errors.New("no build command")
+					continue
+				}
+			}
+			s.emit(LevelInfo, "restart requested; reloading...", Event{Type: EventRestarting, PID: pid, Uptime: s.proc.uptime()})
+			s.starting = req.reply
+			s.restart(ReasonManual, changes)
+			return true
+		case <-closed:
+			s.emit(LevelInfo, "watcher closed; stopping executable...", Event{Type: EventExited, PID: pid, Uptime: s.proc.uptime()})
+			s.stop(s.proc, stopGrace, hookEnv{reason: reasonShutdown})
+			s.retiring.Wait()
+			return false
+		}
+	}
+}
+
+// started replies to the request which started this generation, if
+// any, with the result.
+func (s *Supervisor) started(err error) {
+	if s.starting != nil {
+		s.starting <- err
+		s.starting = nil
+	}
+}
+
+// restart stops the current generation, or leaves it to be stopped
+// once the next one is ready if there are listeners, and waits for the
+// interval before the next one is started.
+func (s *Supervisor) restart(reason string, changes <-chan string) {
+	if len(s.Listeners) > 0 {
+		s.prev = s.proc
+	} else {
+		s.stop(s.proc, 0, hookEnv{reason: reason, paths: s.changed})
+	}
+	s.reason = reason
+	s.sleep(s.Interval, changes)
+}
+
+// start starts a new generation of the command.
+func (s *Supervisor) start() *process {
+	cmd := exec.Command(s.Cmd, s.Args...)
+	if len(s.Listeners) > 0 {
+		must(s.activate(cmd), "failed to pass listeners")
+	}
+	cmd.Dir = s.Dir
+	s.setCredential(cmd)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.Stdin = os.Stdin
+
+	s.mu.Lock()
+	s.generation++
+	generation := s.generation
+	s.mu.Unlock()
+
+	if cmd.Env == nil {
+		cmd.Env = os.Environ()
+	}
+	cmd.Env = append(cmd.Env, s.environ(generation)...)
+
+	proc := &process{cmd: cmd, generation: generation, started: time.Now(), done: make(chan struct{})}
+	var stdout, stderr io.Closer
+	if s.Output != nil {
+		w1, w2 := s.Output.writers(os.Stdout, os.Stderr, proc.started)
+		cmd.Stdout, cmd.Stderr, stdout, stderr = w1, w2, w1, w2
+	}
+	if s.LogFile != nil {
+		s.LogFile.setGeneration(generation)
+		cmd.Stdout = io.MultiWriter(cmd.Stdout, s.LogFile)
+		cmd.Stderr = io.MultiWriter(cmd.Stderr, s.LogFile)
+	}
+	if s.Tail != nil {
+		cmd.Stdout = io.MultiWriter(cmd.Stdout, s.Tail.writer())
+		cmd.Stderr = io.MultiWriter(cmd.Stderr, s.Tail.writer())
+	}
+
+	// In interactive mode, the command's input is passed on by
+	// readKeys.
+	s.mu.Lock()
+	interactive := s.interactive
+	s.mu.Unlock()
+	var stdin *os.File
+	if interactive {
+		r, w, err := os.Pipe()
+		must(err, "failed to pipe stdin")
+		defer r.Close()
+		cmd.Stdin, stdin = r, w
+	}
+	must(cmd.Start(), "bin.Start()")
+	if stdin != nil {
+		s.mu.Lock()
+		s.stdin = stdin
+		s.mu.Unlock()
+	}
+
+	// Watch for exit.
+	go func() {
+		proc.err = cmd.Wait()
+		if stdout != nil {
+			_ = stdout.Close()
+			_ = stderr.Close()
+		}
+		if stdin != nil {
+			_ = stdin.Close()
+		}
+		close(proc.done)
+	}()
+	return proc
+}
+
+// environ returns the variables describing the given generation to the
+// command: why it was started, the paths which changed, and the exit
+// code of the previous generation if it has already exited.
+func (s *Supervisor) environ(generation int) []string {
+	env := []string{
+		"AUTORELOADER_GENERATION=" + strconv.Itoa(generation),
+		"AUTORELOADER_REASON=" + s.reason,
+		"AUTORELOADER_CHANGED_PATHS=" + strings.Join(s.changed, string(os.PathListSeparator)),
+		"AUTORELOADER_SUPERVISOR_PID=" + strconv.Itoa(os.Getpid()),
+	}
+	s.mu.Lock()
+	if generation > 1 && s.exited == generation-1 {
+		env = append(env, "AUTORELOADER_PREV_EXIT_CODE="+strconv.Itoa(s.exitCode))
+	}
+	s.mu.Unlock()
+	return env
+}
+
+// stop runs the pre-stop hook, stops the process, killing it straight
+// away if grace is zero, and runs the post-stop hook once it has
+// exited. The pre-stop hook is skipped if the process has already
+// exited.
+func (s *Supervisor) stop(proc *process, grace time.Duration, env hookEnv) {
+	env.generation = proc.generation
+	select {
+	case <-proc.done:
+	default:
+		env.pid = proc.cmd.Process.Pid
+		_ = s.hook(HookPreStop, env)
+		if grace == 0 {
+			_ = kill(proc.cmd)
+			<-proc.done
+		} else {
+			proc.terminate(grace)
+		}
+	}
+	code, signal := proc.exitStatus()
+	if signal != 0 {
+		code = 128 + int(signal)
+	}
+	s.mu.Lock()
+	if proc.generation > s.exited {
+		s.exited, s.exitCode = proc.generation, code
+	}
+	s.mu.Unlock()
+
+	env.exitCode, env.exited = code, true
+	_ = s.hook(HookPostStop, env)
+}
+
+// uptime returns how long the process has been running.
+func (p *process) uptime() time.Duration {
+	return time.Since(p.started)
+}
+
+// wait blocks while the command is not running, returning whether it
+// should be started again. If startOnChange is set, it is started on
+// the next change, and otherwise only once requested.
+func (s *Supervisor) wait(changes <-chan string, errs <-chan error, closed <-chan struct{}, startOnChange bool) bool {
+	for {
+		select {
+		case path := <-changes:
+			if !startOnChange {
+				continue
+			}
+			s.changed = []string{path}
+			if len(s.Rules) > 0 || s.Tests != nil || s.Pipeline != nil {
+				s.sleep(s.Interval, changes)
+			}
+			if len(s.Rules) > 0 && !s.act(nil) {
+				continue
+			}
+			if !s.test() {
+				// A restart which the rules chose is not made, so
+				// the next change is built.
+				s.noBuild = false
+				continue
+			}
+			s.emit(LevelInfo, "source changed; rebuilding...", Event{Type: EventChanged, Path: path})
+			s.reason = ReasonChange
+			s.sleep(s.Interval, changes)
+			return true
+		case err := <-errs:
+			must(err, "error while polling files")
+		case req := <-s.requests:
+			switch req.op {
+			case opStop:
+				if s.prev != nil {
+					s.stop(s.prev, stopGrace, hookEnv{reason: reasonStop})
+					s.prev = nil
+				}
+				startOnChange = false
+				s.emit(LevelInfo, "executable stopped", Event{Type: EventStopped})
+				req.reply <- nil
+				continue
+			case opRebuild:
+				if len(s.Build) == 0 && s.Pipeline == nil {
+					req.reply <- errors.New("no build command")
+					continue
+				}
+			}
+			s.starting = req.reply
+			s.reason = ReasonManual
+			return true
+		case <-closed:
+			if s.prev != nil {
+				s.stop(s.prev, stopGrace, hookEnv{reason: reasonShutdown})
+			}
+			s.retiring.Wait()
+			return false
+		}
+	}
+}
+
+// exit waits for any previous generations to stop, then exits with the
+// given code. A Monorepo's binary returns instead, to wait for changes,
+// as the others are still running.
+func (s *Supervisor) exit(code int) {
+	if s.prev != nil {
+		s.stop(s.prev, stopGrace, hookEnv{reason: reasonShutdown})
+		s.prev = nil
+	}
+	if s.proc != nil {
+		<-s.proc.done
+	}
+	s.retiring.Wait()
+	if s.name != "" {
+		s.Log.Info("waiting for changes...", Fields{"service": s.name, "exit_code": code})
+		return
+	}
+	s.mu.Lock()
+	if s.restoreTerm != nil {
+		s.restoreTerm()
+	}
+	s.mu.Unlock()
+	os.Exit(code)
+}
+
+// probe starts the readiness and liveness probes for the process with
+// the given pid, which run until stop is closed. The ready channel is
+// closed once the readiness probe first passes, or straight away if
+// there is none, and unhealthy receives the error once the liveness
+// probe fails.
+func (s *Supervisor) probe(pid int, stop <-chan struct{}) (ready <-chan struct{}, unhealthy <-chan error) {
+	var (
+		readyc     = make(chan struct{})
+		unhealthyc = make(chan error, 1)
+		once       sync.Once
+	)
+	if p := s.Readiness; p != nil {
+		started := time.Now()
+		go p.run(false, stop, func(passed bool, err error) {
+			if passed {
+				s.emit(LevelInfo, "executable ready", Event{Type: EventReady, PID: pid, Duration: time.Since(started)})
+				once.Do(func() { close(readyc) })
+				return
+			}
+			s.emit(LevelWarn, "executable not ready", Event{Type: EventUnready, PID: pid, Err: err})
+		})
+	}
+	if p := s.Liveness; p != nil {
+		go p.run(true, stop, func(alive bool, err error) {
+			if alive {
+				return
+			}
+			select {
+			case unhealthyc <- err:
+			default:
+			}
+		})
+	}
+	if s.Readiness == nil {
+		s.emit(LevelDebug, "executable ready", Event{Type: EventReady, PID: pid})
+		close(readyc)
+	}
+	return readyc, unhealthyc
+}
+
+// sleep blocks for the given duration, adding any changes to those
+// which start the next generation.
+func (s *Supervisor) sleep(d time.Duration, changes <-chan string) {
+	timer := time.After(d)
+	for {
+		select {
+		case path := <-changes:
+			if !contains(s.changed, path) {
+				s.changed = append(s.changed, path)
+			}
+		case <-timer:
+			return
+		}
+	}
+}
@@ -0,0 +1,100 @@
+package watcher
+
+import (
+	"bytes"
+	"io"
+	"sync"
+)
+
+// Tail keeps the most recent lines of the command's output.
+type Tail struct {
+	mu        sync.Mutex
+	lines     []string // a ring of the most recent lines
+	next      int      // the index of the next line in the ring
+	full      bool
+	followers map[chan string]struct{}
+}
+
+// NewTail returns a Tail keeping the given number of lines.
+func NewTail(n int) *Tail {
+	return &Tail{
+		lines:     make([]string, n),
+		followers: make(map[chan string]struct{}),
+	}
+}
+
+// writer returns a writer adding each line written to it, so that
+// stdout and stderr are split into lines separately.
+func (t *Tail) writer() io.Writer {
+	return &tailWriter{t: t}
+}
+
+// add adds a line, passing it on to every follower which keeps up.
+func (t *Tail) add(line string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.lines[t.next] = line
+	t.next = (t.next + 1) % len(t.lines)
+	if t.next == 0 {
+		t.full = true
+	}
+	for c := range t.followers {
+		select {
+		case c <- line:
+		default:
+		}
+	}
+}
+
+// follow returns up to the last n lines and, if follow is set, a
+// channel receiving subsequent lines until cancel is called.
+func (t *Tail) follow(n int, follow bool) (lines []string, next <-chan string, cancel func()) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	ordered := t.lines[:t.next]
+	if t.full {
+		ordered = append(append([]string(nil), t.lines[t.next:]...), ordered...)
+	}
+	if n < len(ordered) {
+		ordered = ordered[len(ordered)-n:]
+	}
+	lines = append([]string(nil), ordered...)
+
+	if !follow {
+		return lines, nil, func() {}
+	}
+	c := make(chan string, 256)
+	t.followers[c] = struct{}{}
+	return lines, c, func() {
+		t.mu.Lock()
+		delete(t.followers, c)
+		t.mu.Unlock()
+	}
+}
+
+// tailWriter splits the output written to it into lines for a Tail.
+type tailWriter struct {
+	t   *Tail
+	buf []byte
+}
+
+// Write adds every complete line in p to the Tail.
+func (w *tailWriter) Write(p []byte) (int, error) {
+	w.buf = append(w.buf, p...)
+	for {
+		i := bytes.IndexByte(w.buf, '\n')
+		if i < 0 {
+			break
+		}
+		w.t.add(string(w.buf[:i+1]))
+		w.buf = w.buf[i+1:]
+	}
+	if len(w.buf) >= maxLineLength {
+		w.t.add(string(w.buf) + "\n")
+		w.buf = nil
+	}
+	w.buf = append([]byte(nil), w.buf...)
+	return len(p), nil
+}
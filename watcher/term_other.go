@@ -0,0 +1,13 @@
+//go:build !darwin && !dragonfly && !freebsd && !linux && !netbsd && !openbsd
+// +build !darwin,!dragonfly,!freebsd,!linux,!netbsd,!openbsd
+
+package watcher
+
+import (
+	"github.com/pkg/errors"
+)
+
+// makeCbreak is not supported on this platform.
+func makeCbreak(fd int) (restore func() error, err error) {
+	return nil, errors.New("terminal keys are not supported on this platform")
+}
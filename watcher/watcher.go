@@ -1,7 +1,6 @@
 package watcher
 
 import (
-	"fmt"
 	"log"
 	"os/exec"
 )
@@ -21,9 +20,8 @@ type Watcher interface {
 	Start() error
 }
 
-// kill terminates the given command, printing a reason.
-func kill(bin *exec.Cmd, reason string) error {
-	fmt.Println(reason)
+// kill terminates the given command.
+func kill(bin *exec.Cmd) error {
 	return bin.Process.Kill()
 }
 